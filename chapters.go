@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xprop"
+)
+
+// ChapterMonitor adds chapters when the title of the captured window
+// changes, and when it gains or loses focus.
+type ChapterMonitor struct {
+	elCh   chan xgb.Event
+	xu     *xgbutil.XUtil
+	client xproto.Window
+	add    func(t time.Time, title string)
+
+	netWmName xproto.Atom
+	title     string
+	focused   bool
+}
+
+func NewChapterMonitor(xu *xgbutil.XUtil, el *EventLoop, win *Window, add func(t time.Time, title string)) (*ChapterMonitor, error) {
+	// The title is set on the client window, but the user may have
+	// given us the window manager's frame.
+	client := clientWindow(xu, xproto.Window(win.ID))
+	netWmName, err := xprop.Atm(xu, "_NET_WM_NAME")
+	if err != nil {
+		return nil, err
+	}
+	cm := &ChapterMonitor{
+		elCh:      make(chan xgb.Event),
+		xu:        xu,
+		client:    client,
+		add:       add,
+		netWmName: netWmName,
+	}
+
+	mask := uint32(xproto.EventMaskPropertyChange | xproto.EventMaskFocusChange)
+	if client == xproto.Window(win.ID) {
+		// Selecting events replaces our previous selection on the
+		// same window, and we still need to know about resizes.
+		mask |= xproto.EventMaskStructureNotify
+	}
+	err = xproto.ChangeWindowAttributesChecked(xu.Conn(), client,
+		xproto.CwEventMask, []uint32{mask}).Check()
+	if err != nil {
+		return nil, err
+	}
+
+	// The recording starts with a chapter named after the window.
+	cm.title = cm.windowTitle()
+	if cm.title != "" {
+		add(time.Now(), cm.title)
+	}
+	if focus, err := xproto.GetInputFocus(xu.Conn()).Reply(); err == nil {
+		cm.focused = focus.Focus == client
+	}
+
+	el.Register(cm.elCh)
+	go cm.start()
+	return cm, nil
+}
+
+func (cm *ChapterMonitor) windowTitle() string {
+	return windowTitle(cm.xu, cm.client)
+}
+
+func (cm *ChapterMonitor) start() {
+	for ev := range cm.elCh {
+		switch ev := ev.(type) {
+		case xproto.PropertyNotifyEvent:
+			if ev.Window != cm.client || (ev.Atom != cm.netWmName && ev.Atom != xproto.AtomWmName) {
+				continue
+			}
+			// Applications usually set both properties, so only
+			// the first of the two changes creates a chapter.
+			title := cm.windowTitle()
+			if title == cm.title {
+				continue
+			}
+			cm.title = title
+			cm.add(time.Now(), title)
+		case xproto.FocusInEvent:
+			if ev.Event == cm.client && isFocusChange(ev.Mode, ev.Detail) && !cm.focused {
+				cm.focused = true
+				cm.add(time.Now(), "Focus gained")
+			}
+		case xproto.FocusOutEvent:
+			if ev.Event == cm.client && isFocusChange(ev.Mode, ev.Detail) && cm.focused {
+				cm.focused = false
+				cm.add(time.Now(), "Focus lost")
+			}
+		}
+	}
+}
+
+// isFocusChange reports whether a focus event reflects the window
+// actually gaining or losing focus, as opposed to keyboard grabs or
+// focus moving between the window's children.
+func isFocusChange(mode, detail byte) bool {
+	if mode == xproto.NotifyModeGrab || mode == xproto.NotifyModeUngrab {
+		return false
+	}
+	return detail != xproto.NotifyDetailInferior && detail != xproto.NotifyDetailPointer
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"sync"
+)
+
+// compressor compresses blocks on a pool of goroutines and hands
+// them to write in the order they were submitted.
+type compressor struct {
+	jobs    chan *compressJob
+	pending chan *compressJob
+	done    chan struct{}
+	bufs    sync.Pool
+	write   func(tc, dur uint64, block []byte) error
+
+	mu  sync.Mutex
+	err error
+}
+
+type compressJob struct {
+	tc   uint64
+	dur  uint64
+	in   *bytes.Buffer
+	out  *bytes.Buffer
+	done chan struct{}
+}
+
+func newCompressor(workers int, write func(tc, dur uint64, block []byte) error) *compressor {
+	if workers < 1 {
+		workers = 1
+	}
+	c := &compressor{
+		jobs: make(chan *compressJob),
+		// Allow for some reordering between workers without
+		// letting the backlog grow without bounds.
+		pending: make(chan *compressJob, workers*2),
+		done:    make(chan struct{}),
+		bufs: sync.Pool{
+			New: func() interface{} { return new(bytes.Buffer) },
+		},
+		write: write,
+	}
+	for i := 0; i < workers; i++ {
+		go c.worker()
+	}
+	go c.emit()
+	return c
+}
+
+func (c *compressor) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Submit queues a frame for compression. The frame is copied, so the
+// caller may reuse data once Submit returns. Errors that occur while
+// writing are returned by later calls to Submit or by Close.
+func (c *compressor) Submit(tc, dur uint64, data []byte) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	in := c.bufs.Get().(*bytes.Buffer)
+	in.Reset()
+	in.Write(data)
+	job := &compressJob{
+		tc:   tc,
+		dur:  dur,
+		in:   in,
+		done: make(chan struct{}),
+	}
+	c.pending <- job
+	c.jobs <- job
+	return nil
+}
+
+func (c *compressor) worker() {
+	zw, _ := zlib.NewWriterLevel(nil, zlib.BestSpeed)
+	for job := range c.jobs {
+		out := c.bufs.Get().(*bytes.Buffer)
+		out.Reset()
+		zw.Reset(out)
+		zw.Write(job.in.Bytes())
+		zw.Close()
+		job.out = out
+		close(job.done)
+	}
+}
+
+func (c *compressor) emit() {
+	defer close(c.done)
+	for job := range c.pending {
+		<-job.done
+		if c.Err() == nil {
+			if err := c.write(job.tc, job.dur, job.out.Bytes()); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+			}
+		}
+		c.bufs.Put(job.in)
+		c.bufs.Put(job.out)
+	}
+}
+
+// Close waits for all submitted frames to be written.
+func (c *compressor) Close() error {
+	close(c.jobs)
+	close(c.pending)
+	<-c.done
+	return c.Err()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// A ControlFunc implements a command of the control socket. arg is
+// everything following the command name. The returned value, if not
+// nil, is sent back to the client as JSON.
+type ControlFunc func(arg string) (interface{}, error)
+
+// ControlServer accepts commands on a Unix socket. Commands are sent
+// one per line, either as plain text ("marker some label") or as JSON
+// objects ({"command": "marker", "argument": "some label"}).
+// Responses use the same format as the request: "ok", "error: ..." or
+// a line of JSON for plain text, and a JSON object for JSON.
+type ControlServer struct {
+	ln       net.Listener
+	commands map[string]ControlFunc
+}
+
+type controlRequest struct {
+	Command  string `json:"command"`
+	Argument string `json:"argument"`
+}
+
+type controlResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+func NewControlServer(path string, commands map[string]ControlFunc) (*ControlServer, error) {
+	// Remove stale sockets left behind by crashed instances.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	cs := &ControlServer{ln: ln, commands: commands}
+	go cs.serve()
+	return cs, nil
+}
+
+func (cs *ControlServer) serve() {
+	var delay time.Duration
+	for {
+		conn, err := cs.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Back off on errors such as running out of file
+			// descriptors, like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go cs.handle(conn)
+	}
+}
+
+func (cs *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var req controlRequest
+		isJSON := strings.HasPrefix(line, "{")
+		if isJSON {
+			if err := json.Unmarshal([]byte(line), &req); err != nil {
+				cs.respond(conn, true, nil, fmt.Errorf("malformed request: %s", err))
+				continue
+			}
+		} else {
+			parts := strings.SplitN(line, " ", 2)
+			req.Command = parts[0]
+			if len(parts) == 2 {
+				req.Argument = strings.TrimSpace(parts[1])
+			}
+		}
+		fn, ok := cs.commands[req.Command]
+		if !ok {
+			cs.respond(conn, isJSON, nil, fmt.Errorf("unknown command %q", req.Command))
+			continue
+		}
+		res, err := fn(req.Argument)
+		cs.respond(conn, isJSON, res, err)
+	}
+}
+
+func (cs *ControlServer) respond(conn net.Conn, isJSON bool, res interface{}, err error) {
+	var b []byte
+	if isJSON {
+		resp := controlResponse{OK: err == nil, Result: res}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		b, _ = json.Marshal(resp)
+	} else if err != nil {
+		b = []byte("error: " + err.Error())
+	} else if res != nil {
+		b, _ = json.Marshal(res)
+	} else {
+		b = []byte("ok")
+	}
+	b = append(b, '\n')
+	if _, err := conn.Write(b); err != nil {
+		log.Println("Couldn't respond on control socket:", err)
+	}
+}
+
+// Close stops accepting commands and removes the socket.
+func (cs *ControlServer) Close() error {
+	return cs.ln.Close()
+}
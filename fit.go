@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type FitMode int
+
+const (
+	// FitCrop draws the window in the top left corner of the canvas,
+	// cutting off what doesn't fit.
+	FitCrop FitMode = iota
+	// FitPad aligns the window on the canvas according to the anchor,
+	// cutting off what doesn't fit.
+	FitPad
+	// FitScale scales the window to fit the canvas, keeping its aspect
+	// ratio, and centers it.
+	FitScale
+	// FitStretch scales the window to the size of the canvas.
+	FitStretch
+	// FitAdaptive doesn't draw the window onto a canvas at all.
+	// Instead, frames keep the window's size, and the recording
+	// starts a new part whenever it changes.
+	FitAdaptive
+)
+
+type Filter int
+
+const (
+	FilterNearest Filter = iota
+	FilterBilinear
+	FilterArea
+)
+
+// anchors maps the names of anchors to their position, in halves of
+// the free space to the left of and above the window.
+var anchors = map[string][2]int{
+	"nw": {0, 0}, "n": {1, 0}, "ne": {2, 0},
+	"w": {0, 1}, "center": {1, 1}, "e": {2, 1},
+	"sw": {0, 2}, "s": {1, 2}, "se": {2, 2},
+}
+
+// A Fit draws images of the captured window onto the canvas when
+// their sizes differ.
+type Fit struct {
+	Mode   FitMode
+	Anchor [2]int
+	Filter Filter
+
+	// The kernels and scratch space of the last scaling operation,
+	// which usually repeats for many frames.
+	hk, vk [][]contrib
+	hsize  [2]int
+	vsize  [2]int
+	tmp    []byte
+	acc    []int32
+}
+
+func parseFit(mode, filter string) (*Fit, error) {
+	f := &Fit{}
+	switch {
+	case mode == "crop":
+		f.Mode = FitCrop
+	case mode == "pad-center":
+		f.Mode = FitPad
+		f.Anchor = anchors["center"]
+	case strings.HasPrefix(mode, "pad-anchor="):
+		a, ok := anchors[strings.TrimPrefix(mode, "pad-anchor=")]
+		if !ok {
+			return nil, fmt.Errorf("invalid anchor in %q, must be one of nw, n, ne, w, center, e, sw, s or se", mode)
+		}
+		f.Mode = FitPad
+		f.Anchor = a
+	case mode == "scale":
+		f.Mode = FitScale
+	case mode == "stretch":
+		f.Mode = FitStretch
+	case mode == "adaptive":
+		f.Mode = FitAdaptive
+	default:
+		return nil, fmt.Errorf("invalid fit mode %q", mode)
+	}
+	switch filter {
+	case "nearest":
+		f.Filter = FilterNearest
+	case "bilinear":
+		f.Filter = FilterBilinear
+	case "area":
+		f.Filter = FilterArea
+	default:
+		return nil, fmt.Errorf("invalid filter %q", filter)
+	}
+	return f, nil
+}
+
+// Draw draws the w×h image src onto the canvas dst, filling the rest
+// of the canvas with black.
+func (f *Fit) Draw(dst []byte, canvas Canvas, src []byte, w, h int) {
+	switch f.Mode {
+	case FitCrop, FitPad, FitAdaptive:
+		ox := (canvas.Width - w) * f.Anchor[0] / 2
+		oy := (canvas.Height - h) * f.Anchor[1] / 2
+		dx, sx := ox, 0
+		if ox < 0 {
+			dx, sx = 0, -ox
+		}
+		dy, sy := oy, 0
+		if oy < 0 {
+			dy, sy = 0, -oy
+		}
+		n := min(w-sx, canvas.Width-dx)
+		rows := min(h-sy, canvas.Height-dy)
+		if n < canvas.Width || rows < canvas.Height {
+			zero(dst)
+		}
+		for i := 0; i < rows; i++ {
+			d := dst[((dy+i)*canvas.Width+dx)*bytesPerPixel:]
+			copy(d[:n*bytesPerPixel], src[((sy+i)*w+sx)*bytesPerPixel:])
+		}
+	case FitScale:
+		dw, dh := canvas.Width, canvas.Height
+		if w*canvas.Height > h*canvas.Width {
+			dh = max(1, int(math.Round(float64(h)*float64(canvas.Width)/float64(w))))
+		} else {
+			dw = max(1, int(math.Round(float64(w)*float64(canvas.Height)/float64(h))))
+		}
+		if dw < canvas.Width || dh < canvas.Height {
+			zero(dst)
+		}
+		f.resample(dst, canvas, (canvas.Width-dw)/2, (canvas.Height-dh)/2, dw, dh, src, w, h)
+	case FitStretch:
+		f.resample(dst, canvas, 0, 0, canvas.Width, canvas.Height, src, w, h)
+	}
+}
+
+// contrib is the weight with which a source pixel contributes to a
+// destination pixel.
+type contrib struct {
+	idx    int
+	weight int32
+}
+
+// weightBits is the precision of the weights of the kernels.
+const weightBits = 14
+
+// kernel computes, for every pixel of a row or column of length dst,
+// which pixels of a row or column of length src contribute to it.
+func kernel(filter Filter, src, dst int) [][]contrib {
+	const one = 1 << weightBits
+	k := make([][]contrib, dst)
+	scale := float64(src) / float64(dst)
+	for i := range k {
+		switch filter {
+		case FilterNearest:
+			s := min(int((float64(i)+0.5)*scale), src-1)
+			k[i] = []contrib{{s, one}}
+		case FilterBilinear:
+			c := math.Max((float64(i)+0.5)*scale-0.5, 0)
+			s := int(c)
+			if s >= src-1 {
+				k[i] = []contrib{{src - 1, one}}
+				continue
+			}
+			w := int32(math.Round((c - float64(s)) * one))
+			k[i] = []contrib{{s, one - w}, {s + 1, w}}
+		case FilterArea:
+			// Average the source pixels covered by the destination
+			// pixel, weighted by how much of them is covered.
+			lo, hi := float64(i)*scale, float64(i+1)*scale
+			var cs []contrib
+			var total int32
+			largest := 0
+			for s := int(lo); s < src && float64(s) < hi; s++ {
+				overlap := math.Min(hi, float64(s+1)) - math.Max(lo, float64(s))
+				w := int32(math.Round(overlap / scale * one))
+				if len(cs) > 0 && w > cs[largest].weight {
+					largest = len(cs)
+				}
+				cs = append(cs, contrib{s, w})
+				total += w
+			}
+			// Make up for rounding errors, so that weights add up to
+			// exactly one.
+			cs[largest].weight += one - total
+			k[i] = cs
+		}
+	}
+	return k
+}
+
+// resample scales the w×h image src to dw×dh and draws it at dx, dy
+// onto the canvas dst. It scales horizontally first, then vertically.
+func (f *Fit) resample(dst []byte, canvas Canvas, dx, dy, dw, dh int, src []byte, w, h int) {
+	if f.hk == nil || f.hsize != [2]int{w, dw} {
+		f.hk = kernel(f.Filter, w, dw)
+		f.hsize = [2]int{w, dw}
+	}
+	if f.vk == nil || f.vsize != [2]int{h, dh} {
+		f.vk = kernel(f.Filter, h, dh)
+		f.vsize = [2]int{h, dh}
+	}
+	stride := dw * bytesPerPixel
+	if n := stride * h; len(f.tmp) < n {
+		f.tmp = make([]byte, n)
+	}
+	if len(f.acc) < stride {
+		f.acc = make([]int32, stride)
+	}
+
+	const half = 1 << (weightBits - 1)
+	for y := 0; y < h; y++ {
+		srow := src[y*w*bytesPerPixel : (y+1)*w*bytesPerPixel]
+		trow := f.tmp[y*stride : (y+1)*stride]
+		for x, cs := range f.hk {
+			var b, g, r, a int32
+			for _, c := range cs {
+				p := srow[c.idx*bytesPerPixel : c.idx*bytesPerPixel+bytesPerPixel]
+				b += int32(p[0]) * c.weight
+				g += int32(p[1]) * c.weight
+				r += int32(p[2]) * c.weight
+				a += int32(p[3]) * c.weight
+			}
+			t := trow[x*bytesPerPixel : x*bytesPerPixel+bytesPerPixel]
+			t[0] = clampByte((b + half) >> weightBits)
+			t[1] = clampByte((g + half) >> weightBits)
+			t[2] = clampByte((r + half) >> weightBits)
+			t[3] = clampByte((a + half) >> weightBits)
+		}
+	}
+
+	acc := f.acc[:stride]
+	for y, cs := range f.vk {
+		for i := range acc {
+			acc[i] = 0
+		}
+		for _, c := range cs {
+			trow := f.tmp[c.idx*stride : (c.idx+1)*stride]
+			for i, v := range trow {
+				acc[i] += int32(v) * c.weight
+			}
+		}
+		off := ((dy+y)*canvas.Width + dx) * bytesPerPixel
+		drow := dst[off : off+stride]
+		for i, v := range acc {
+			drow[i] = clampByte((v + half) >> weightBits)
+		}
+	}
+}
+
+func clampByte(v int32) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// solid returns a w×h image whose pixels all have the value v.
+func solid(w, h int, v byte) []byte {
+	return bytes.Repeat([]byte{v}, w*h*bytesPerPixel)
+}
+
+func pixel(data []byte, canvas Canvas, x, y int) byte {
+	return data[(y*canvas.Width+x)*bytesPerPixel]
+}
+
+func TestParseFit(t *testing.T) {
+	tests := []struct {
+		mode   string
+		fit    FitMode
+		anchor [2]int
+		ok     bool
+	}{
+		{"crop", FitCrop, [2]int{0, 0}, true},
+		{"pad-center", FitPad, [2]int{1, 1}, true},
+		{"pad-anchor=se", FitPad, [2]int{2, 2}, true},
+		{"pad-anchor=n", FitPad, [2]int{1, 0}, true},
+		{"pad-anchor=up", 0, [2]int{}, false},
+		{"scale", FitScale, [2]int{0, 0}, true},
+		{"stretch", FitStretch, [2]int{0, 0}, true},
+		{"zoom", 0, [2]int{}, false},
+	}
+	for _, tt := range tests {
+		f, err := parseFit(tt.mode, "bilinear")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.mode, err)
+			continue
+		}
+		if err == nil && (f.Mode != tt.fit || f.Anchor != tt.anchor) {
+			t.Errorf("%s: got mode %d with anchor %v, want %d with %v", tt.mode, f.Mode, f.Anchor, tt.fit, tt.anchor)
+		}
+	}
+	if _, err := parseFit("scale", "bicubic"); err == nil {
+		t.Error("accepted invalid filter")
+	}
+}
+
+func TestFitPad(t *testing.T) {
+	canvas := Canvas{Width: 4, Height: 4}
+	f, _ := parseFit("pad-anchor=se", "nearest")
+	dst := solid(4, 4, 7)
+	f.Draw(dst, canvas, solid(2, 2, 1), 2, 2)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			want := byte(0)
+			if x >= 2 && y >= 2 {
+				want = 1
+			}
+			if got := pixel(dst, canvas, x, y); got != want {
+				t.Errorf("pixel %d,%d is %d, want %d", x, y, got, want)
+			}
+		}
+	}
+
+	// A larger window gets cut off evenly on all sides.
+	f, _ = parseFit("pad-center", "nearest")
+	src := make([]byte, 6*6*bytesPerPixel)
+	for i := range src {
+		src[i] = byte(i / bytesPerPixel)
+	}
+	dst = solid(4, 4, 0xff)
+	f.Draw(dst, canvas, src, 6, 6)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			// Canvas pixel x,y shows window pixel x+1,y+1.
+			if got, want := pixel(dst, canvas, x, y), byte((y+1)*6+x+1); got != want {
+				t.Errorf("pixel %d,%d is %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestFitScale(t *testing.T) {
+	canvas := Canvas{Width: 8, Height: 8}
+	for _, filter := range []string{"nearest", "bilinear", "area"} {
+		f, _ := parseFit("scale", filter)
+		dst := solid(8, 8, 7)
+		// A wide window gets letterboxed to 8×4, centered.
+		f.Draw(dst, canvas, solid(16, 8, 200), 16, 8)
+		for y := 0; y < 8; y++ {
+			want := byte(200)
+			if y < 2 || y >= 6 {
+				want = 0
+			}
+			for x := 0; x < 8; x++ {
+				if got := pixel(dst, canvas, x, y); got != want {
+					t.Fatalf("%s: pixel %d,%d is %d, want %d", filter, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFitFilters(t *testing.T) {
+	// A 4×1 image of alternating black and white pixels, shrunk to
+	// 2×1.
+	src := []byte{
+		0, 0, 0, 0, 255, 255, 255, 255,
+		0, 0, 0, 0, 255, 255, 255, 255,
+	}
+	canvas := Canvas{Width: 2, Height: 1}
+	tests := map[string]byte{
+		"nearest":  255,
+		"bilinear": 128,
+		"area":     128,
+	}
+	for filter, want := range tests {
+		f, _ := parseFit("stretch", filter)
+		dst := make([]byte, 2*bytesPerPixel)
+		f.Draw(dst, canvas, src, 4, 1)
+		for x := 0; x < 2; x++ {
+			if got := pixel(dst, canvas, x, 0); got != want {
+				t.Errorf("%s: pixel %d is %d, want %d", filter, x, got, want)
+			}
+		}
+	}
+
+	// Shrinking by a factor of four, bilinear filtering only looks at
+	// two of the four pixels, while area averages all of them.
+	src = []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 200, 200, 200, 200,
+	}
+	canvas = Canvas{Width: 1, Height: 1}
+	for filter, want := range map[string]byte{"bilinear": 0, "area": 50} {
+		f, _ := parseFit("stretch", filter)
+		dst := make([]byte, bytesPerPixel)
+		f.Draw(dst, canvas, src, 4, 1)
+		if dst[0] != want {
+			t.Errorf("%s: got %d, want %d", filter, dst[0], want)
+		}
+	}
+}
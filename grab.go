@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/xgb"
+	xshm "github.com/BurntSushi/xgb/shm"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// A Grabber copies a rectangle of a drawable into a page of its
+// buffer. Rows are stored without padding, starting at the beginning
+// of the page.
+type Grabber interface {
+	Buffer() Buffer
+	Grab(d xproto.Drawable, x, y, width, height, page int) error
+	Close() error
+}
+
+// ShmGrabber uses the MIT-SHM extension to have the X server write
+// images directly into our memory.
+type ShmGrabber struct {
+	conn *xgb.Conn
+	seg  xshm.Seg
+	buf  Buffer
+}
+
+func NewShmGrabber(conn *xgb.Conn, pageSize, pages int) (*ShmGrabber, error) {
+	seg, err := xshm.NewSegId(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain ID for SHM: %s", err)
+	}
+	buf, err := NewBuffer(pageSize, pages, func(shmID int) error {
+		if err := xshm.AttachChecked(conn, seg, uint32(shmID), false).Check(); err != nil {
+			return fmt.Errorf("could not attach shared memory to X server: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ShmGrabber{conn: conn, seg: seg, buf: buf}, nil
+}
+
+func (g *ShmGrabber) Buffer() Buffer { return g.buf }
+
+func (g *ShmGrabber) Grab(d xproto.Drawable, x, y, width, height, page int) error {
+	_, err := xshm.GetImage(g.conn, d, int16(x), int16(y), uint16(width), uint16(height),
+		0xFFFFFFFF, xproto.ImageFormatZPixmap, g.seg, uint32(g.buf.PageOffset(page))).Reply()
+	return err
+}
+
+func (g *ShmGrabber) Close() error {
+	xshm.Detach(g.conn, g.seg)
+	return g.buf.Close()
+}
+
+// ImageGrabber uses plain GetImage requests, which works without
+// MIT-SHM, for example over the network, but is a lot slower.
+type ImageGrabber struct {
+	conn *xgb.Conn
+	buf  Buffer
+	// maxStrip is the maximum number of bytes we request at once.
+	maxStrip int
+}
+
+func NewImageGrabber(conn *xgb.Conn, pageSize, pages int) (*ImageGrabber, error) {
+	buf, err := NewMemoryBuffer(pageSize, pages)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageGrabber{
+		conn:     conn,
+		buf:      buf,
+		maxStrip: int(xproto.Setup(conn).MaximumRequestLength) * 4,
+	}, nil
+}
+
+func (g *ImageGrabber) Buffer() Buffer { return g.buf }
+
+func (g *ImageGrabber) Grab(d xproto.Drawable, x, y, width, height, page int) error {
+	_, err := getImage(g.conn, d, x, y, width, height, g.maxStrip, g.buf.Page(page))
+	return err
+}
+
+// getImage fetches a rectangle of d into dst, using GetImage requests
+// of at most maxStrip bytes each. It returns the depth of the image.
+func getImage(conn *xgb.Conn, d xproto.Drawable, x, y, width, height, maxStrip int, dst []byte) (depth byte, err error) {
+	stride := width * bytesPerPixel
+	rows := maxStrip / stride
+	if rows < 1 {
+		rows = 1
+	}
+
+	// Request all strips before waiting for the first reply, so we
+	// only pay for one round trip.
+	var cookies []xproto.GetImageCookie
+	for row := 0; row < height; row += rows {
+		h := min(rows, height-row)
+		cookies = append(cookies, xproto.GetImage(conn, xproto.ImageFormatZPixmap, d,
+			int16(x), int16(y+row), uint16(width), uint16(h), 0xFFFFFFFF))
+	}
+
+	for i, c := range cookies {
+		reply, rerr := c.Reply()
+		if rerr != nil {
+			// Keep collecting replies so they don't pile up.
+			err = rerr
+			continue
+		}
+		if err == nil {
+			copy(dst[i*rows*stride:], reply.Data)
+			depth = reply.Depth
+		}
+	}
+	return depth, err
+}
+
+func (g *ImageGrabber) Close() error { return g.buf.Close() }
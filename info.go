@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska"
+	"honnef.co/go/xcapture/internal/matroska/ebml"
+)
+
+// RecordingInfo is the summary of a recording printed by the info
+// subcommand. Durations are in seconds.
+type RecordingInfo struct {
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Frames      int     `json:"frames"`
+	CFR         bool    `json:"cfr"`
+	FPS         float64 `json:"fps"`
+	Duration    float64 `json:"duration_seconds"`
+	MinInterval float64 `json:"min_interval_seconds"`
+	AvgInterval float64 `json:"avg_interval_seconds"`
+	MaxInterval float64 `json:"max_interval_seconds"`
+	// Keepalives is the number of frames that repeat the previous
+	// frame because nothing changed for a second in VFR mode.
+	Keepalives int               `json:"keepalive_frames"`
+	Tags       map[string]string `json:"tags"`
+	Chapters   []ChapterInfo     `json:"chapters"`
+	Cues       bool              `json:"cues"`
+	// Finalized is set if the segment has a known size, which is
+	// the case for files that were completely written.
+	Finalized bool `json:"finalized"`
+	// Truncated is set if the file ends in the middle of an
+	// element.
+	Truncated bool `json:"truncated"`
+}
+
+type ChapterInfo struct {
+	Start float64 `json:"start_seconds"`
+	Title string  `json:"title"`
+}
+
+func inspect(r io.Reader) (*RecordingInfo, error) {
+	mr, err := matroska.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var track *matroska.Track
+	for i := range mr.Segment.Tracks {
+		if mr.Segment.Tracks[i].Type == matroska.VideoTrack {
+			track = &mr.Segment.Tracks[i]
+			break
+		}
+	}
+	if track == nil {
+		return nil, fmt.Errorf("file has no video track")
+	}
+	info := &RecordingInfo{
+		Finalized: mr.SegmentSize != ebml.UnknownSize,
+	}
+	if track.Video != nil {
+		info.Width = track.Video.PixelWidth
+		info.Height = track.Video.PixelHeight
+	}
+	if track.DefaultDuration > 0 {
+		info.FPS = float64(time.Second) / float64(track.DefaultDuration)
+	}
+
+	var first, prev, end time.Duration
+	var prevData []byte
+	var minIvl, maxIvl, sum time.Duration
+	cfr := true
+	for {
+		p, err := mr.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			info.Truncated = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.Track != track.Number {
+			continue
+		}
+		if info.Frames == 0 {
+			first = p.Timecode
+		} else {
+			d := p.Timecode - prev
+			if info.Frames == 1 || d < minIvl {
+				minIvl = d
+			}
+			if d > maxIvl {
+				maxIvl = d
+			}
+			sum += d
+			if d != track.DefaultDuration {
+				cfr = false
+			}
+			// In VFR mode, the writer repeats the last frame once
+			// nothing has changed for a second.
+			if d >= time.Second && bytes.Equal(p.Data, prevData) {
+				info.Keepalives++
+			}
+		}
+		info.Frames++
+		prev = p.Timecode
+		prevData = p.Data
+		end = p.Timecode + p.Duration
+	}
+
+	info.CFR = cfr && info.Frames > 1
+	if info.CFR {
+		// In CFR mode, repeated frames are simply duplicates.
+		info.Keepalives = 0
+	}
+	if info.Frames > 0 {
+		info.Duration = (end - first).Seconds()
+	}
+	if info.Frames > 1 {
+		info.MinInterval = minIvl.Seconds()
+		info.MaxInterval = maxIvl.Seconds()
+		info.AvgInterval = (sum / time.Duration(info.Frames-1)).Seconds()
+	}
+	info.Tags = mr.Segment.Tags
+	if info.Tags == nil {
+		info.Tags = map[string]string{}
+	}
+	info.Chapters = []ChapterInfo{}
+	for _, ch := range mr.Chapters {
+		info.Chapters = append(info.Chapters, ChapterInfo{ch.Start.Seconds(), ch.Title})
+	}
+	info.Cues = len(mr.Cues) > 0
+	return info, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func printInfo(w io.Writer, info *RecordingInfo) {
+	mode := "VFR"
+	if info.CFR {
+		mode = "CFR"
+	}
+	fmt.Fprintf(w, "Canvas:          %dx%d\n", info.Width, info.Height)
+	fmt.Fprintf(w, "Frames:          %d\n", info.Frames)
+	fmt.Fprintf(w, "Frame rate:      %s, %g fps\n", mode, info.FPS)
+	fmt.Fprintf(w, "Duration:        %s\n", seconds(info.Duration))
+	fmt.Fprintf(w, "Frame interval:  min %s, avg %s, max %s\n",
+		seconds(info.MinInterval), seconds(info.AvgInterval), seconds(info.MaxInterval))
+	if !info.CFR {
+		fmt.Fprintf(w, "Keepalives:      %d\n", info.Keepalives)
+	}
+	fmt.Fprintf(w, "Cues:            %s\n", yesNo(info.Cues))
+	fmt.Fprintf(w, "Finalized:       %s\n", yesNo(info.Finalized))
+	fmt.Fprintf(w, "Truncated:       %s\n", yesNo(info.Truncated))
+
+	if len(info.Tags) > 0 {
+		fmt.Fprintln(w, "Tags:")
+		var names []string
+		for name := range info.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %-15s %s\n", name, info.Tags[name])
+		}
+	}
+	if len(info.Chapters) > 0 {
+		fmt.Fprintln(w, "Chapters:")
+		for _, ch := range info.Chapters {
+			fmt.Fprintf(w, "  %-15s %s\n", seconds(ch.Start), ch.Title)
+		}
+	}
+}
+
+func infoMain(args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the summary as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: xcapture info [-json] [file]")
+		fmt.Fprintln(os.Stderr, "Reads from standard input if no file is given.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		if name := fs.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	info, err := inspect(r)
+	if err != nil {
+		log.Fatal("Couldn't read recording:", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printInfo(os.Stdout, info)
+}
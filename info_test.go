@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInspect(t *testing.T) {
+	canvas := Canvas{Width: 2, Height: 2}
+	var buf bytes.Buffer
+	vw := NewVideoWriter(canvas, 10, false, map[string]string{"WINDOW_ID": "1"}, &buf)
+	if err := vw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	send := func(off time.Duration, data []byte) {
+		if err := vw.SendFrame(Frame{Data: data, Time: start.Add(off)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(0, make([]byte, 16))
+	send(100*time.Millisecond, bytes.Repeat([]byte{1}, 16))
+	// Nothing changes for more than a second, which makes the
+	// writer repeat the last frame.
+	send(1200*time.Millisecond, nil)
+	send(1300*time.Millisecond, bytes.Repeat([]byte{2}, 16))
+	vw.AddChapter(start.Add(1300*time.Millisecond), "end")
+	if err := vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := inspect(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 2 || info.Height != 2 || info.Frames != 4 || info.CFR || info.Keepalives != 1 {
+		t.Errorf("unexpected summary %+v", info)
+	}
+	if info.MinInterval != 0.1 || info.MaxInterval != 1.1 {
+		t.Errorf("got intervals %g to %g, want 0.1 to 1.1", info.MinInterval, info.MaxInterval)
+	}
+	if info.Duration != 1.4 {
+		t.Errorf("got duration %g, want 1.4", info.Duration)
+	}
+	if info.Tags["WINDOW_ID"] != "1" || len(info.Chapters) != 1 || info.Cues || info.Truncated {
+		t.Errorf("unexpected summary %+v", info)
+	}
+
+	// Cut the file in the middle of the last cluster
+	cluster := []byte{0x1F, 0x43, 0xB6, 0x75}
+	truncated := buf.Bytes()[:bytes.LastIndex(buf.Bytes(), cluster)+10]
+	info, err = inspect(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Truncated || info.Frames != 3 {
+		t.Errorf("got truncated=%t with %d frames, want truncated file with 3 frames", info.Truncated, info.Frames)
+	}
+}
+
+func TestInspectCFR(t *testing.T) {
+	canvas := Canvas{Width: 2, Height: 2}
+	var buf bytes.Buffer
+	vw := NewVideoWriter(canvas, 10, true, nil, &buf)
+	if err := vw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	data := make([]byte, 16)
+	for i := 0; i < 5; i++ {
+		// Nothing changes after the first frame, so the writer
+		// duplicates it.
+		frame := Frame{Time: start.Add(time.Duration(i) * 100 * time.Millisecond)}
+		if i == 0 {
+			frame.Data = data
+		}
+		if err := vw.SendFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := inspect(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.CFR || info.Frames != 5 || info.Keepalives != 0 {
+		t.Errorf("got %d frames with %d keepalives and cfr=%t, want 5 CFR frames without keepalives", info.Frames, info.Keepalives, info.CFR)
+	}
+}
@@ -0,0 +1,246 @@
+package ebml
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// UnknownSize is the Size of elements whose size wasn't known when
+// they were written, such as live streams.
+const UnknownSize = -1
+
+// maxDataSize is the size of the largest element whose data we're
+// willing to read into memory.
+const maxDataSize = 1 << 30
+
+var ErrInvalid = errors.New("ebml: invalid data")
+
+// A Header is the header of an element as read by a Decoder.
+type Header struct {
+	// ID is the element's ID, including the marker bits, the same
+	// as Element.Class.
+	ID uint64
+	// Size is the size of the element's data, or UnknownSize.
+	Size int64
+	// Offset is the position of the header, Data the position of
+	// the element's data.
+	Offset int64
+	Data   int64
+}
+
+// Is reports whether the element has the given ID.
+func (h Header) Is(id ElementID) bool {
+	return h.ID == id().Class
+}
+
+// End returns the position of the first byte after the element. It
+// is only meaningful if the size is known.
+func (h Header) End() int64 {
+	return h.Data + h.Size
+}
+
+// Decoder reads EBML elements from a stream. It doesn't know about
+// the structure of any particular document type. Users call Next to
+// read an element's header, and then either descend into it by
+// calling Next again, read its value, or Skip it.
+type Decoder struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Position returns the number of bytes consumed so far.
+func (d *Decoder) Position() int64 {
+	return d.pos
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.pos++
+	return b, nil
+}
+
+func (d *Decoder) read(b []byte) error {
+	n, err := io.ReadFull(d.r, b)
+	d.pos += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readVarint reads a variable length integer. If keepMarker is set,
+// the length marker is kept, as is the case for IDs. It returns the
+// value, the number of bytes it occupied and whether all value bits
+// were set.
+func (d *Decoder) readVarint(keepMarker bool) (v uint64, n int, allOnes bool, err error) {
+	first, err := d.readByte()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	n = 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		n++
+		if mask == 1 {
+			return 0, 0, false, ErrInvalid
+		}
+	}
+	v = uint64(first)
+	if !keepMarker {
+		v &^= 0x80 >> uint(n-1)
+	}
+	var rest [7]byte
+	if err := d.read(rest[:n-1]); err != nil {
+		return 0, 0, false, err
+	}
+	for _, b := range rest[:n-1] {
+		v = v<<8 | uint64(b)
+	}
+	allOnes = v == 1<<(7*uint(n))-1
+	return v, n, allOnes, nil
+}
+
+// Next reads the header of the next element. It returns io.EOF if
+// the stream ends cleanly before the element, and
+// io.ErrUnexpectedEOF if it ends in the middle of the header.
+func (d *Decoder) Next() (Header, error) {
+	h := Header{Offset: d.pos}
+	id, n, _, err := d.readVarint(true)
+	if err != nil {
+		return Header{}, err
+	}
+	if n > 4 {
+		return Header{}, fmt.Errorf("ebml: invalid element ID at offset %d", h.Offset)
+	}
+	size, _, unknown, err := d.readVarint(false)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Header{}, err
+	}
+	h.ID = id
+	h.Size = int64(size)
+	if unknown {
+		h.Size = UnknownSize
+	}
+	h.Data = d.pos
+	return h, nil
+}
+
+// Skip skips over the remaining data of the element. Elements of
+// unknown size can't be skipped.
+func (d *Decoder) Skip(h Header) error {
+	if h.Size == UnknownSize {
+		return fmt.Errorf("ebml: can't skip element %x of unknown size", h.ID)
+	}
+	n := h.End() - d.pos
+	if n < 0 {
+		return fmt.Errorf("ebml: already past the end of element %x", h.ID)
+	}
+	m, err := d.r.Discard(int(n))
+	d.pos += int64(m)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Bytes reads the data of the element. The decoder has to be
+// positioned at the start of the data.
+func (d *Decoder) Bytes(h Header) ([]byte, error) {
+	if h.Size == UnknownSize || h.Size > maxDataSize {
+		return nil, fmt.Errorf("ebml: can't read element %x of size %d", h.ID, h.Size)
+	}
+	b := make([]byte, h.Size)
+	if err := d.read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *Decoder) number(h Header) (uint64, error) {
+	if h.Size > 8 {
+		return 0, fmt.Errorf("ebml: integer element %x is %d bytes long", h.ID, h.Size)
+	}
+	b, err := d.Bytes(h)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// Uint reads the value of an unsigned integer element.
+func (d *Decoder) Uint(h Header) (uint64, error) {
+	return d.number(h)
+}
+
+// Int reads the value of a signed integer element.
+func (d *Decoder) Int(h Header) (int64, error) {
+	v, err := d.number(h)
+	if err != nil || h.Size == 0 {
+		return 0, err
+	}
+	// Sign extend
+	shift := uint(64 - 8*h.Size)
+	return int64(v<<shift) >> shift, nil
+}
+
+// Float reads the value of a 4 or 8 byte float element.
+func (d *Decoder) Float(h Header) (float64, error) {
+	switch h.Size {
+	case 0:
+		return 0, nil
+	case 4, 8:
+	default:
+		return 0, fmt.Errorf("ebml: float element %x is %d bytes long", h.ID, h.Size)
+	}
+	v, err := d.number(h)
+	if err != nil {
+		return 0, err
+	}
+	if h.Size == 4 {
+		return float64(math.Float32frombits(uint32(v))), nil
+	}
+	return math.Float64frombits(v), nil
+}
+
+// String reads the value of a String or UTF-8 element. Trailing
+// zero bytes, which may be used as padding, are removed.
+func (d *Decoder) String(h Header) (string, error) {
+	b, err := d.Bytes(h)
+	if err != nil {
+		return "", err
+	}
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return string(b), nil
+}
+
+// Date reads the value of a Date element.
+func (d *Decoder) Date(h Header) (time.Time, error) {
+	if h.Size != 0 && h.Size != 8 {
+		return time.Time{}, fmt.Errorf("ebml: date element %x is %d bytes long", h.ID, h.Size)
+	}
+	b, err := d.Bytes(h)
+	if err != nil || len(b) == 0 {
+		return epoch, err
+	}
+	return epoch.Add(time.Duration(int64(binary.BigEndian.Uint64(b)))), nil
+}
@@ -3,30 +3,105 @@ package ebml
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 type Int int64
 type Uint uint64
 type Varint uint64
-type Float float64 // XXX what about 10 bytes?
+
+// Float is a floating point number. It is written with 4 bytes if
+// that doesn't lose any precision, and with 8 bytes otherwise.
+type Float float64
+
+// Float64 is a floating point number that is always written with 8
+// bytes, for values that get overwritten later.
+type Float64 float64
+
 type String string
 type UTF8 string
-type Date struct{}
+
+// Date is a point in time, stored with nanosecond precision relative
+// to the start of the third millennium.
+type Date time.Time
+
 type Binary []byte
 
-// XXX return minimal sizes
-func (i Int) Size() int    { return 8 }
-func (u Uint) Size() int   { return 8 }
-func (f Float) Size() int  { return 8 }
-func (u UTF8) Size() int   { return len(u) }
-func (s String) Size() int { return len(s) }
-func (b Binary) Size() int { return len(b) }
-
-// XXX write minimal versions
-func (i Int) Write(w io.Writer) error   { return binary.Write(w, binary.BigEndian, i) }
-func (u Uint) Write(w io.Writer) error  { return binary.Write(w, binary.BigEndian, u) }
-func (f Float) Write(w io.Writer) error { return binary.Write(w, binary.BigEndian, f) }
+// Spliceable is binary data that may be handed to the kernel by
+// reference when writing to a pipe, instead of being copied. The
+// caller must not modify it until the reader of the pipe has
+// consumed it, as reported by Encoder.Consumed.
+type Spliceable []byte
+
+// epoch is the origin of EBML dates.
+var epoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// intSize returns the number of bytes needed to store i in two's
+// complement.
+func intSize(i int64) int {
+	if i == 0 {
+		return 0
+	}
+	n := 1
+	for ; n < 8; n++ {
+		shift := uint(64 - 8*n)
+		if i<<shift>>shift == i {
+			break
+		}
+	}
+	return n
+}
+
+func (i Int) Size() int        { return intSize(int64(i)) }
+func (u Uint) Size() int       { return len(shortest(uint64(u))) }
+func (f Float) Size() int      { return f.width() }
+func (f Float64) Size() int    { return 8 }
+func (d Date) Size() int       { return 8 }
+func (u UTF8) Size() int       { return len(u) }
+func (s String) Size() int     { return len(s) }
+func (b Binary) Size() int     { return len(b) }
+func (b Spliceable) Size() int { return len(b) }
+
+func (f Float) width() int {
+	if float64(float32(f)) == float64(f) {
+		return 4
+	}
+	return 8
+}
+
+func (i Int) Write(w io.Writer) error {
+	n := i.Size()
+	b := make([]byte, n)
+	for j := range b {
+		b[j] = byte(i >> uint((n-j-1)*8))
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (u Uint) Write(w io.Writer) error {
+	_, err := w.Write(shortest(uint64(u)))
+	return err
+}
+
+func (f Float) Write(w io.Writer) error {
+	if f.width() == 4 {
+		return binary.Write(w, binary.BigEndian, float32(f))
+	}
+	return binary.Write(w, binary.BigEndian, float64(f))
+}
+
+func (f Float64) Write(w io.Writer) error { return binary.Write(w, binary.BigEndian, f) }
+
+func (d Date) Write(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, int64(time.Time(d).Sub(epoch)))
+}
+
 func (u UTF8) Write(w io.Writer) error {
 	_, err := w.Write([]byte(u))
 	return err
@@ -39,6 +114,14 @@ func (b Binary) Write(w io.Writer) error {
 	_, err := w.Write(b)
 	return err
 }
+func (b Spliceable) Write(w io.Writer) error {
+	if v, ok := w.(*vecWriter); ok {
+		v.writeSpliceable(b)
+		return nil
+	}
+	_, err := w.Write(b)
+	return err
+}
 
 func (v Varint) Write(w io.Writer) error {
 	// TODO(dh): in theory, there could be more than 8 bytes, which we
@@ -72,6 +155,19 @@ func (v Varint) Length() int {
 	return len(b)
 }
 
+// unknownSize is the value of an 8 byte varint with all value bits
+// set, which denotes an element of unknown size.
+const unknownSize = 1<<56 - 1
+
+// putVarint encodes v as a varint that occupies exactly len(b) bytes.
+func putVarint(b []byte, v uint64) {
+	n := uint(len(b))
+	v |= 1 << (7 * n)
+	for i := range b {
+		b[i] = byte(v >> ((n - uint(i) - 1) * 8))
+	}
+}
+
 type Padding int
 
 func (p Padding) Size() int { return int(p) }
@@ -88,6 +184,12 @@ func (p Padding) Write(w io.Writer) error {
 
 type ElementID func(children ...Object) Element
 
+// Bytes returns the encoded form of the element ID, as used by
+// SeekID.
+func (id ElementID) Bytes() []byte {
+	return shortest(id().Class)
+}
+
 func EBML(children ...Object) Element                 { return Element{0x1A45DFA3, children} }
 func EBMLVersion(children ...Object) Element          { return Element{0x4286, children} }
 func EBMLReadVersion(children ...Object) Element      { return Element{0x42F7, children} }
@@ -198,8 +300,17 @@ func (e Element) internalSize() int {
 }
 
 type Encoder struct {
-	Err error
-	w   *trackedWriter
+	Err  error
+	w    *trackedWriter
+	base int64
+	vec  vecWriter
+	// pipe is the output if it is a pipe, and grown is set once
+	// we tried to make it larger.
+	pipe  *os.File
+	grown bool
+	// written mirrors w.pos for Consumed, which may be called
+	// concurrently.
+	written int64
 }
 
 type trackedWriter struct {
@@ -213,21 +324,108 @@ func (w *trackedWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+func (w *trackedWriter) writeBuffers(bufs [][]byte) error {
+	n, err := writeBuffers(w.w, bufs)
+	w.pos += int(n)
+	return err
+}
+
+func (w *trackedWriter) vmsplice(f *os.File, bufs [][]byte) error {
+	n, err := writeVectored(f, bufs, vmsplice)
+	w.pos += int(n)
+	return err
+}
+
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: &trackedWriter{w: w}}
+	enc := &Encoder{w: &trackedWriter{w: w}}
+	if s, ok := w.(io.Seeker); ok {
+		// Positions are relative to where we started writing, which
+		// need not be the beginning of the file.
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+			enc.base = off
+		}
+	}
+	if f, ok := w.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+			enc.pipe = f
+		}
+	}
+	return enc
 }
 
 func (e *Encoder) Position() int {
 	return e.w.pos
 }
 
+// Seek moves the encoder to the given position, as returned by
+// Position. The underlying writer has to implement io.Seeker.
+func (e *Encoder) Seek(pos int) error {
+	if e.Err != nil {
+		return e.Err
+	}
+	s, ok := e.w.w.(io.Seeker)
+	if !ok {
+		e.Err = errors.New("ebml: writer does not support seeking")
+		return e.Err
+	}
+	if _, err := s.Seek(e.base+int64(pos), io.SeekStart); err != nil {
+		e.Err = err
+		return e.Err
+	}
+	e.w.pos = pos
+	return nil
+}
+
+// EmitVoid writes a Void element that occupies exactly size bytes,
+// including its header. Size must be at least 2.
+func (e *Encoder) EmitVoid(size int) error {
+	if e.Err != nil {
+		return e.Err
+	}
+	if size < 2 {
+		e.Err = fmt.Errorf("ebml: can't write Void element of %d bytes", size)
+		return e.Err
+	}
+	var b []byte
+	if size-2 < 127 {
+		b = []byte{0xEC, 0}
+	} else {
+		// Use an 8 byte size so that we don't have to care about
+		// the size of the size.
+		b = make([]byte, 9)
+		b[0] = 0xEC
+	}
+	putVarint(b[1:], uint64(size-len(b)))
+	if _, err := e.w.Write(b); err != nil {
+		e.Err = err
+		return e.Err
+	}
+	e.Err = Padding(size - len(b)).Write(e.w)
+	return e.Err
+}
+
 // Emit writes the object and all of its possible children. It
 // calculates the size automatically.
 func (e *Encoder) Emit(obj Object) error {
 	if e.Err != nil {
 		return e.Err
 	}
-	e.Err = obj.Write(e.w)
+	// Collect the whole element first, so that it can be written
+	// with a single system call and without copying large payloads
+	// such as frames.
+	e.vec.reset()
+	if e.Err = obj.Write(&e.vec); e.Err != nil {
+		return e.Err
+	}
+	e.vec.flushScratch()
+	if e.pipe != nil && e.vec.spliceable {
+		e.Err = e.writeSpliced()
+	} else {
+		e.Err = e.w.writeBuffers(e.vec.bufs)
+	}
+	atomic.StoreInt64(&e.written, int64(e.w.pos))
+	// Don't keep the caller's data alive.
+	e.vec.reset()
 	return e.Err
 }
 
@@ -261,7 +459,11 @@ func (e *Encoder) EmitHeader(class ElementID, size int) (Reference, error) {
 
 	sizePos := e.Position()
 	if size < 0 {
-		if _, err := e.w.Write([]byte{255}); err != nil {
+		// Use the widest encoding of the unknown size, so that
+		// FixSize can fill in the real size later.
+		b := make([]byte, 8)
+		putVarint(b, unknownSize)
+		if _, err := e.w.Write(b); err != nil {
 			e.Err = err
 			return Reference{}, e.Err
 		}
@@ -284,3 +486,28 @@ type Reference struct {
 	Size int
 	Data int
 }
+
+// FixSize replaces the size of the element referred to by ref, which
+// must have been written with an unknown size. The underlying writer
+// has to implement io.Seeker.
+func (e *Encoder) FixSize(ref Reference, size int) error {
+	if e.Err != nil {
+		return e.Err
+	}
+	b := make([]byte, ref.Data-ref.Size)
+	if size >= 1<<(7*uint(len(b)))-1 {
+		e.Err = fmt.Errorf("ebml: size %d doesn't fit in %d bytes", size, len(b))
+		return e.Err
+	}
+	putVarint(b, uint64(size))
+
+	pos := e.Position()
+	if err := e.Seek(ref.Size); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(b); err != nil {
+		e.Err = err
+		return e.Err
+	}
+	return e.Seek(pos)
+}
@@ -1,9 +1,17 @@
 package ebml
 
 import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestShortest(t *testing.T) {
@@ -23,3 +31,315 @@ func TestShortest(t *testing.T) {
 		}
 	}
 }
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		obj  interface{ Write(io.Writer) error }
+		want string
+	}{
+		// The VINT examples of RFC 8794, section 4.4, in their
+		// shortest form.
+		{Varint(1), "81"},
+		{Varint(2), "82"},
+		{Varint(126), "fe"},
+		// All value bits set means unknown, so 127 needs two bytes.
+		{Varint(127), "407f"},
+		{Varint(16382), "7ffe"},
+		{Varint(16383), "203fff"},
+
+		// An integer with a length of zero is zero.
+		{Uint(0), ""},
+		{Uint(1), "01"},
+		{Uint(255), "ff"},
+		{Uint(256), "0100"},
+		{Uint(1<<56 - 1), "ffffffffffffff"},
+		{Uint(math.MaxUint64), "ffffffffffffffff"},
+
+		{Int(0), ""},
+		{Int(1), "01"},
+		{Int(-1), "ff"},
+		{Int(127), "7f"},
+		{Int(128), "0080"},
+		{Int(-128), "80"},
+		{Int(-129), "ff7f"},
+		{Int(math.MinInt64), "8000000000000000"},
+
+		{Float(0), "00000000"},
+		{Float(1.5), "3fc00000"},
+		{Float(-2), "c0000000"},
+		{Float(0.1), "3fb999999999999a"},
+		{Float64(1.5), "3ff8000000000000"},
+
+		// Dates count nanoseconds since 2001-01-01T00:00:00 UTC.
+		{Date(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)), "0000000000000000"},
+		{Date(time.Date(2001, 1, 1, 0, 0, 1, 0, time.UTC)), "000000003b9aca00"},
+		{Date(time.Date(2000, 12, 31, 23, 59, 59, 0, time.UTC)), "ffffffffc4653600"},
+
+		{DocTypeVersion(Uint(4)), "428781" + "04"},
+		{EBMLMaxSizeLength(Uint(8)), "42f381" + "08"},
+		{Void(Int(0)), "ec80"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := tt.obj.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != tt.want {
+			t.Errorf("%#v encoded as %s, want %s", tt.obj, got, tt.want)
+		}
+		if obj, ok := tt.obj.(Object); ok && obj.Size() != buf.Len() {
+			t.Errorf("%#v has size %d but encoded to %d bytes", obj, obj.Size(), buf.Len())
+		}
+	}
+}
+
+func TestDateRoundTrip(t *testing.T) {
+	want := time.Date(2017, 6, 25, 14, 1, 22, 123456789, time.UTC)
+	var buf bytes.Buffer
+	NewEncoder(&buf).Emit(DocType(Date(want)))
+	dec := NewDecoder(&buf)
+	h, err := dec.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dec.Date(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.Emit(EBML(
+		DocType(String("matroska\x00\x00")),
+		DocTypeVersion(Uint(4)),
+		DocTypeReadVersion(Int(-2)),
+		Void(Float(1.5))))
+	enc.EmitHeader(SignatureSlot, -1)
+	enc.Emit(SignatureAlgo(Binary{1, 2, 3}))
+	if enc.Err != nil {
+		t.Fatal(enc.Err)
+	}
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	h, err := dec.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Is(EBML) || h.Offset != 0 || h.Data != 5 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	next := func(id ElementID) Header {
+		t.Helper()
+		h, err := dec.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.Is(id) {
+			t.Fatalf("got element %x, want %x", h.ID, id().Class)
+		}
+		return h
+	}
+	if s, err := dec.String(next(DocType)); err != nil || s != "matroska" {
+		t.Errorf("got DocType %q, %v, want %q", s, err, "matroska")
+	}
+	if v, err := dec.Uint(next(DocTypeVersion)); err != nil || v != 4 {
+		t.Errorf("got DocTypeVersion %d, %v, want 4", v, err)
+	}
+	if v, err := dec.Int(next(DocTypeReadVersion)); err != nil || v != -2 {
+		t.Errorf("got DocTypeReadVersion %d, %v, want -2", v, err)
+	}
+	if v, err := dec.Float(next(Void)); err != nil || v != 1.5 {
+		t.Errorf("got %g, %v, want 1.5", v, err)
+	}
+	if h := next(SignatureSlot); h.Size != UnknownSize {
+		t.Errorf("got size %d, want unknown size", h.Size)
+	}
+	h = next(SignatureAlgo)
+	if err := dec.Skip(h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+
+	// Truncated data
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	for err == nil {
+		h, err = dec.Next()
+		if err == nil && !h.Is(EBML) && h.Size != UnknownSize {
+			err = dec.Skip(h)
+		}
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestVectoredWrite(t *testing.T) {
+	frame := make([]byte, 100000)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	elt := EBML(
+		DocTypeVersion(Uint(4)),
+		SignatureSlot(Binary{0x81, 0, 0, 0}, Binary(frame), Binary(frame[:largeWrite])),
+		DocType(String("matroska")))
+
+	var want bytes.Buffer
+	if err := elt.Write(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ebml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	enc := NewEncoder(f)
+	enc.Emit(elt)
+	enc.Emit(elt)
+	if enc.Err != nil {
+		t.Fatal(enc.Err)
+	}
+	if enc.Position() != 2*want.Len() {
+		t.Errorf("encoder is at %d, want %d", enc.Position(), 2*want.Len())
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(want.Bytes(), want.Bytes()...)) {
+		t.Error("vectored write differs from sequential write")
+	}
+}
+
+func BenchmarkEmitFrame(b *testing.B) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	// A 1920x1080 BGRA frame
+	frame := make([]byte, 1920*1080*4)
+	enc := NewEncoder(f)
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		enc.Emit(SignatureSlot(
+			SignatureAlgo(Uint(i)),
+			SignatureElements(Binary{0x81, 0, 0, 0}, Binary(frame))))
+	}
+	if enc.Err != nil {
+		b.Fatal(enc.Err)
+	}
+}
+
+func TestSplice(t *testing.T) {
+	frame, err := unix.Mmap(-1, 0, 1<<20, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(frame)
+	for i := range frame {
+		frame[i] = byte(i * 7)
+	}
+	elt := SignatureSlot(Binary{0x81, 0, 0, 0}, Spliceable(frame))
+	var want bytes.Buffer
+	elt.Write(&want)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		done <- b
+	}()
+	enc := NewEncoder(w)
+	if enc.pipe == nil {
+		t.Fatal("encoder didn't detect the pipe")
+	}
+	enc.Emit(elt)
+	if enc.Err != nil {
+		t.Fatal(enc.Err)
+	}
+	// Only once the reader has read everything may the frame be
+	// modified.
+	for {
+		n, err := enc.Consumed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == enc.Position() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := range frame {
+		frame[i] = 0
+	}
+	w.Close()
+	if got := <-done; !bytes.Equal(got, want.Bytes()) {
+		t.Error("data read from the pipe differs from what was written")
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	// A 1920x1080 BGRA frame, page aligned like our SHM buffers.
+	frame, err := unix.Mmap(-1, 0, 1920*1080*4, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer unix.Munmap(frame)
+	for _, splice := range []bool{false, true} {
+		name := "write"
+		if splice {
+			name = "vmsplice"
+		}
+		b.Run(name, func(b *testing.B) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Use the same pipe size for both, and read in large
+			// chunks, like ffmpeg does.
+			rc, err := w.SyscallConn()
+			if err != nil {
+				b.Fatal(err)
+			}
+			rc.Control(func(fd uintptr) { unix.FcntlInt(fd, unix.F_SETPIPE_SZ, pipeSize) })
+			done := make(chan struct{})
+			go func() {
+				buf := make([]byte, pipeSize)
+				for {
+					if _, err := r.Read(buf); err != nil {
+						break
+					}
+				}
+				close(done)
+			}()
+			var data Object = Binary(frame)
+			if splice {
+				data = Spliceable(frame)
+			}
+			enc := NewEncoder(w)
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				enc.Emit(SignatureSlot(Binary{0x81, 0, 0, 0}, data))
+			}
+			if enc.Err != nil {
+				b.Fatal(enc.Err)
+			}
+			w.Close()
+			<-done
+			r.Close()
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package ebml
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// largeWrite is the size from which vecWriter references data instead
+// of copying it.
+const largeWrite = 512
+
+// pipeSize is the size we try to grow pipes to before splicing into
+// them. It is the default limit for unprivileged users. Splicing
+// frames into the default 64 KiB pipe is slower than copying them.
+const pipeSize = 1 << 20
+
+// maxIovecs is the maximum number of buffers a single call to writev
+// accepts on Linux.
+const maxIovecs = 1024
+
+// vecWriter collects the pieces of an element for a vectored write.
+// Small pieces, such as headers, are copied into a scratch buffer.
+// Large ones are referenced, which means that, unlike other writers,
+// it retains the slices passed to Write until it is reset.
+type vecWriter struct {
+	bufs [][]byte
+	// splice records which of bufs are Spliceable, and spliceable
+	// whether any are.
+	splice     []bool
+	spliceable bool
+	scratch    []byte
+	// cur is the part of scratch that hasn't been added to bufs yet.
+	cur []byte
+}
+
+func (v *vecWriter) reset() {
+	for i := range v.bufs {
+		v.bufs[i] = nil
+	}
+	v.bufs = v.bufs[:0]
+	v.splice = v.splice[:0]
+	v.spliceable = false
+	v.cur = v.scratch[:0]
+}
+
+func (v *vecWriter) Write(b []byte) (int, error) {
+	if len(b) < largeWrite {
+		v.cur = append(v.cur, b...)
+		if cap(v.cur) > cap(v.scratch) {
+			v.scratch = v.cur[:0]
+		}
+		return len(b), nil
+	}
+	v.flushScratch()
+	v.bufs = append(v.bufs, b)
+	v.splice = append(v.splice, false)
+	return len(b), nil
+}
+
+func (v *vecWriter) writeSpliceable(b []byte) {
+	if len(b) < largeWrite {
+		v.Write(b)
+		return
+	}
+	v.flushScratch()
+	v.bufs = append(v.bufs, b)
+	v.splice = append(v.splice, true)
+	v.spliceable = true
+}
+
+func (v *vecWriter) flushScratch() {
+	if len(v.cur) == 0 {
+		return
+	}
+	v.bufs = append(v.bufs, v.cur)
+	v.splice = append(v.splice, false)
+	// Further small writes go after the data we just added. If they
+	// don't fit, append allocates a new array and leaves the old one
+	// alone.
+	v.cur = v.cur[len(v.cur):]
+}
+
+// writeBuffers writes all of bufs to w, using writev where possible.
+func writeBuffers(w io.Writer, bufs [][]byte) (int64, error) {
+	if f, ok := w.(*os.File); ok {
+		return writevFile(f, bufs)
+	}
+	b := net.Buffers(bufs)
+	return b.WriteTo(w)
+}
+
+func writevFile(f *os.File, bufs [][]byte) (int64, error) {
+	return writeVectored(f, bufs, unix.Writev)
+}
+
+func vmsplice(fd int, bufs [][]byte) (int, error) {
+	iovs := make([]unix.Iovec, len(bufs))
+	for i, b := range bufs {
+		iovs[i].Base = &b[0]
+		iovs[i].SetLen(len(b))
+	}
+	return unix.Vmsplice(fd, iovs, 0)
+}
+
+// writeVectored writes all of bufs to f, using fn, which has the
+// semantics of writev.
+func writeVectored(f *os.File, bufs [][]byte, fn func(fd int, bufs [][]byte) (int, error)) (int64, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for len(bufs) > 0 {
+		iovs := bufs
+		if len(iovs) > maxIovecs {
+			iovs = iovs[:maxIovecs]
+		}
+		var n int
+		var werr error
+		err := rc.Write(func(fd uintptr) bool {
+			n, werr = fn(int(fd), iovs)
+			return werr != unix.EAGAIN
+		})
+		if err == nil {
+			err = werr
+		}
+		if n > 0 {
+			total += int64(n)
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.ErrShortWrite
+		}
+		// Skip what has been written, which may end in the middle
+		// of a buffer.
+		for n > 0 {
+			if n < len(bufs[0]) {
+				bufs[0] = bufs[0][n:]
+				break
+			}
+			n -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+	}
+	return total, nil
+}
+
+// writeSpliced writes the collected element to the pipe, passing
+// Spliceable data to the kernel by reference and copying the rest.
+func (e *Encoder) writeSpliced() error {
+	if !e.grown {
+		e.grown = true
+		if rc, err := e.pipe.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				// This is merely an optimization, so ignore errors.
+				unix.FcntlInt(fd, unix.F_SETPIPE_SZ, pipeSize)
+			})
+		}
+	}
+	bufs, splice := e.vec.bufs, e.vec.splice
+	for len(bufs) > 0 {
+		n := 1
+		for n < len(bufs) && splice[n] == splice[0] {
+			n++
+		}
+		var err error
+		if splice[0] {
+			err = e.w.vmsplice(e.pipe, bufs[:n])
+		} else {
+			err = e.w.writeBuffers(bufs[:n])
+		}
+		if err != nil {
+			return err
+		}
+		bufs, splice = bufs[n:], splice[n:]
+	}
+	return nil
+}
+
+// Consumed returns the position up to which the output has been
+// consumed. For pipes, that is the data that the reader has read
+// from the pipe, for everything else, all data that has been
+// written. Unlike the other methods, it may be called concurrently.
+func (e *Encoder) Consumed() (int, error) {
+	written := int(atomic.LoadInt64(&e.written))
+	if e.pipe == nil {
+		return written, nil
+	}
+	rc, err := e.pipe.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var unread int
+	var ioctlErr error
+	err = rc.Control(func(fd uintptr) {
+		// TIOCINQ is the same as FIONREAD, the number of bytes in
+		// the pipe.
+		unread, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCINQ)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return written - unread, nil
+}
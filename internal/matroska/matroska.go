@@ -1,67 +1,566 @@
 package matroska
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sort"
 	"time"
 
 	"honnef.co/go/xcapture/internal/matroska/ebml"
 )
 
+// MKV writes a Matroska file with a single segment. The exported
+// fields describe the segment and have to be set before calling
+// Write. Afterwards, frames are added with WriteFrame, and the file
+// is finalized by Close.
+//
+// Every frame is stored in a cluster of its own. This wastes a few
+// bytes per frame, but means that a truncated file loses at most its
+// last frame.
+//
+// If the underlying writer is a regular file or otherwise seekable,
+// Close writes Cues, a SeekHead, the Duration and the final size of
+// the segment. Otherwise the result is a live stream without index.
+//
+// An MKV is not safe for concurrent use.
 type MKV struct {
 	SegmentUID      [16]byte
 	SegmentFilename string
 	PrevUID         [16]byte
 	PrevFilename    string
-	NextUID         [16]byte
-	NextFilename    string
-	SegmentFamily   [][16]byte
+	// NextUID links to the following segment. If it is cleared before
+	// Close and the output is seekable, the link is removed again.
+	NextUID       [16]byte
+	NextFilename  string
+	SegmentFamily [][16]byte
 	// TODO ChapterTranslate
 	TimecodeScale time.Duration
 	Duration      time.Duration
 	Date          time.Time
 	Title         string
 	WritingApp    string
+
+	Tracks      []Track
+	Tags        map[string]string
+	Attachments []Attachment
+
+	enc      *ebml.Encoder
+	seekable bool
+	segment  ebml.Reference
+	chapters []Chapter
+
+	// Positions of the reserved space and placeholders that Close
+	// fills in.
+	seekHead     int
+	chapterSpace int
+	duration     int
+	nextUID      int
+	nextUIDSize  int
+
+	seeks       []seekEntry
+	cues        []cuePoint
+	clusterSize int
+	// lastFrame is the timecode of the previous frame of each
+	// track, which non-keyframes refer to.
+	lastFrame map[int]time.Duration
+	// start is the timecode of the first frame, end the time at which
+	// the last frame ends.
+	start, end time.Duration
+	frames     int
+}
+
+type TrackKind int
+
+const (
+	VideoTrack    TrackKind = 1
+	AudioTrack    TrackKind = 2
+	SubtitleTrack TrackKind = 0x11
+)
+
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	// Zlib means that frames are compressed with zlib.
+	Zlib
+)
+
+type Track struct {
+	Number          int
+	UID             uint64
+	Type            TrackKind
+	CodecID         string
+	CodecPrivate    []byte
+	DefaultDuration time.Duration
+	Compression     Compression
+	Video           *VideoSettings
+}
+
+type VideoSettings struct {
+	PixelWidth     int
+	PixelHeight    int
+	ColourSpace    []byte
+	BitsPerChannel int
+}
+
+type Attachment struct {
+	UID         uint64
+	Name        string
+	MIMEType    string
+	Description string
+	Data        []byte
+}
+
+type Chapter struct {
+	Start time.Duration
+	Title string
+}
+
+// A Frame is a single frame of a track.
+type Frame struct {
+	Track int
+	// Timecode is the frame's presentation time. Duration, if not
+	// zero, is stored in the file, which is required for tracks
+	// without a constant frame rate.
+	Timecode time.Duration
+	Duration time.Duration
+	Keyframe bool
+	Data     []byte
+	// Spliceable allows passing Data to the kernel by reference if
+	// the output is a pipe. The caller must not modify Data until
+	// Consumed has passed the position after the frame.
+	Spliceable bool
+}
+
+// seekHeadSize is the number of bytes we reserve for the SeekHead at
+// the beginning of the segment.
+const seekHeadSize = 256
+
+// chaptersSize is the number of bytes we reserve for the Chapters
+// after the SeekHead, so that players find them without having to
+// seek to the end of the file. Chapters that don't fit get written
+// at the end.
+const chaptersSize = 4096
+
+type seekEntry struct {
+	id  ebml.ElementID
+	pos int
+}
+
+type cuePoint struct {
+	time  uint64
+	track int
+	pos   int
 }
 
 func (mkv *MKV) Size() int {
 	return mkv.generate().Size()
 }
 
+// Info returns the segment's Info element.
+func (mkv *MKV) Info() ebml.Element {
+	return mkv.generate()
+}
+
+func (mkv *MKV) timecodeScale() time.Duration {
+	if mkv.TimecodeScale == 0 {
+		return 1
+	}
+	return mkv.TimecodeScale
+}
+
 func (mkv *MKV) generate() ebml.Element {
-	var elts []ebml.Element
-	SegmentUID(ebml.Binary(mkv.SegmentUID[:]))
+	var zero [16]byte
+	var elts []ebml.Object
+	if mkv.SegmentUID != zero {
+		elts = append(elts, SegmentUID(ebml.Binary(mkv.SegmentUID[:])))
+	}
 	if mkv.SegmentFilename != "" {
 		elts = append(elts, SegmentFilename(ebml.UTF8(mkv.SegmentFilename)))
 	}
-	PrevUID(ebml.Binary(mkv.PrevUID[:]))
+	if mkv.PrevUID != zero {
+		elts = append(elts, PrevUID(ebml.Binary(mkv.PrevUID[:])))
+	}
 	if mkv.PrevFilename != "" {
 		elts = append(elts, PrevFilename(ebml.UTF8(mkv.PrevFilename)))
 	}
-	NextUID(ebml.Binary(mkv.NextUID[:]))
+	if mkv.NextUID != zero {
+		elts = append(elts, NextUID(ebml.Binary(mkv.NextUID[:])))
+	}
 	if mkv.NextFilename != "" {
 		elts = append(elts, NextFilename(ebml.UTF8(mkv.NextFilename)))
 	}
 	for _, sf := range mkv.SegmentFamily {
 		elts = append(elts, SegmentFamily(ebml.Binary(sf[:])))
 	}
-	ts := mkv.TimecodeScale
-	if ts == 0 {
-		ts = 1
-	}
+	ts := mkv.timecodeScale()
 	elts = append(elts, TimecodeScale(ebml.Uint(uint64(ts))))
-	// Duration
-	// Date
+	if mkv.Duration != 0 {
+		elts = append(elts, Duration(ebml.Float(mkv.Duration/ts)))
+	}
+	if !mkv.Date.IsZero() {
+		elts = append(elts, DateUTC(ebml.Date(mkv.Date)))
+	}
 	if mkv.Title != "" {
 		elts = append(elts, Title(ebml.UTF8(mkv.Title)))
 	}
 	elts = append(elts, MuxingApp(ebml.UTF8("honnef.co/go/mkv")))
 	elts = append(elts, WritingApp(ebml.UTF8(mkv.WritingApp)))
 
-	return ebml.Element{}
+	return Info(elts...)
 }
 
+func (t Track) generate() ebml.Element {
+	children := []ebml.Object{
+		TrackNumber(ebml.Uint(t.Number)),
+		TrackUID(ebml.Uint(t.UID)),
+		TrackType(ebml.Uint(t.Type)),
+		FlagLacing(ebml.Uint(0)),
+	}
+	if t.DefaultDuration != 0 {
+		children = append(children, DefaultDuration(ebml.Uint(t.DefaultDuration)))
+	}
+	children = append(children, CodecID(ebml.String(t.CodecID)))
+	if t.CodecPrivate != nil {
+		children = append(children, CodecPrivate(ebml.Binary(t.CodecPrivate)))
+	}
+	if v := t.Video; v != nil {
+		video := []ebml.Object{
+			PixelWidth(ebml.Uint(v.PixelWidth)),
+			PixelHeight(ebml.Uint(v.PixelHeight)),
+		}
+		if v.ColourSpace != nil {
+			video = append(video, ColourSpace(ebml.Binary(v.ColourSpace)))
+		}
+		if v.BitsPerChannel != 0 {
+			video = append(video, Colour(BitsPerChannel(ebml.Uint(v.BitsPerChannel))))
+		}
+		children = append(children, Video(video...))
+	}
+	if t.Compression == Zlib {
+		children = append(children, ContentEncodings(
+			ContentEncoding(
+				ContentEncodingOrder(ebml.Uint(0)),
+				// Frame contents
+				ContentEncodingScope(ebml.Uint(1)),
+				// Compression
+				ContentEncodingType(ebml.Uint(0)),
+				ContentCompression(
+					// zlib
+					ContentCompAlgo(ebml.Uint(0))))))
+	}
+	return TrackEntry(children...)
+}
+
+// isSeekable reports whether we can go back in w to fill in the
+// index. Pipes and terminals claim to support seeking, but don't.
+func isSeekable(w io.Writer) bool {
+	if f, ok := w.(*os.File); ok {
+		fi, err := f.Stat()
+		return err == nil && fi.Mode().IsRegular()
+	}
+	_, ok := w.(io.Seeker)
+	return ok
+}
+
+// segmentPosition returns the current position relative to the
+// start of the segment's data, which is what Matroska uses for all
+// positions.
+func (mkv *MKV) segmentPosition() int {
+	return mkv.enc.Position() - mkv.segment.Data
+}
+
+func (mkv *MKV) markSeek(id ebml.ElementID) {
+	if !mkv.seekable {
+		return
+	}
+	mkv.seeks = append(mkv.seeks, seekEntry{id, mkv.segmentPosition()})
+}
+
+// Position returns the number of bytes written so far.
+func (mkv *MKV) Position() int {
+	if mkv.enc == nil {
+		return 0
+	}
+	return mkv.enc.Position()
+}
+
+// Write starts writing the file to w. It writes the EBML header and
+// all the metadata that precedes the first cluster.
 func (mkv *MKV) Write(w io.Writer) error {
-	return nil
+	if mkv.enc != nil {
+		return errors.New("matroska: Write called twice")
+	}
+	mkv.enc = ebml.NewEncoder(w)
+	mkv.seekable = isSeekable(w)
+	mkv.lastFrame = map[int]time.Duration{}
+
+	mkv.enc.Emit(
+		ebml.EBML(
+			ebml.DocType(ebml.String("matroska")),
+			ebml.DocTypeVersion(ebml.Uint(4)),
+			ebml.DocTypeReadVersion(ebml.Uint(1))))
+
+	mkv.segment, _ = mkv.enc.EmitHeader(Segment, -1)
+	if mkv.seekable {
+		// Reserve space for the SeekHead, which we can only write
+		// once we know where the Cues are, and for the Chapters.
+		mkv.seekHead = mkv.enc.Position()
+		mkv.enc.EmitVoid(seekHeadSize)
+		mkv.chapterSpace = mkv.enc.Position()
+		mkv.enc.EmitVoid(chaptersSize)
+	}
+
+	mkv.markSeek(Info)
+	children := mkv.generate().Children
+	if mkv.seekable && mkv.Duration == 0 {
+		// We don't know the duration yet. Write a placeholder that
+		// Close will overwrite.
+		children = append(children, Duration(ebml.Float64(0)))
+	}
+	size := 0
+	for _, c := range children {
+		size += c.Size()
+	}
+	mkv.enc.EmitHeader(Info, size)
+	for _, c := range children {
+		switch c.(ebml.Element).Class {
+		case Duration().Class:
+			mkv.duration = mkv.enc.Position()
+		case NextUID().Class:
+			mkv.nextUID = mkv.enc.Position()
+			mkv.nextUIDSize = c.Size()
+		}
+		mkv.enc.Emit(c)
+	}
+
+	if len(mkv.Tags) > 0 {
+		names := make([]string, 0, len(mkv.Tags))
+		for name := range mkv.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var tags []ebml.Object
+		for _, name := range names {
+			tags = append(tags, Tag(
+				SimpleTag(
+					TagName(ebml.UTF8(name)),
+					TagString(ebml.UTF8(mkv.Tags[name])))))
+		}
+		mkv.markSeek(Tags)
+		mkv.enc.Emit(Tags(tags...))
+	}
+
+	var tracks []ebml.Object
+	for _, t := range mkv.Tracks {
+		tracks = append(tracks, t.generate())
+	}
+	mkv.markSeek(Tracks)
+	mkv.enc.Emit(Tracks(tracks...))
+
+	if len(mkv.Attachments) > 0 {
+		var files []ebml.Object
+		for _, a := range mkv.Attachments {
+			file := []ebml.Object{}
+			if a.Description != "" {
+				file = append(file, FileDescription(ebml.UTF8(a.Description)))
+			}
+			file = append(file,
+				FileName(ebml.UTF8(a.Name)),
+				FileMimeType(ebml.String(a.MIMEType)),
+				FileData(ebml.Binary(a.Data)),
+				FileUID(ebml.Uint(a.UID)))
+			files = append(files, AttachedFile(file...))
+		}
+		mkv.markSeek(Attachments)
+		mkv.enc.Emit(Attachments(files...))
+	}
+	return mkv.enc.Err
+}
+
+// WriteFrame writes a frame in a cluster of its own. Frames have to
+// be written in the order of their timecodes.
+func (mkv *MKV) WriteFrame(f Frame) error {
+	if mkv.enc == nil {
+		return errors.New("matroska: WriteFrame called before Write")
+	}
+	if f.Track < 1 || f.Track > 127 {
+		return fmt.Errorf("matroska: unsupported track number %d", f.Track)
+	}
+	ts := mkv.timecodeScale()
+	tc := uint64(f.Timecode / ts)
+
+	// Track number, a relative timecode of 0, and no flags.
+	header := ebml.Binary{0x80 | byte(f.Track), 0, 0, 0}
+	var data ebml.Object = ebml.Binary(f.Data)
+	if f.Spliceable {
+		data = ebml.Spliceable(f.Data)
+	}
+	group := []ebml.Object{Block(header, data)}
+	if f.Duration != 0 {
+		group = append(group, BlockDuration(ebml.Uint(f.Duration/ts)))
+	}
+	if prev, ok := mkv.lastFrame[f.Track]; ok && !f.Keyframe {
+		group = append(group, ReferenceBlock(ebml.Int((prev-f.Timecode)/ts)))
+	}
+	mkv.lastFrame[f.Track] = f.Timecode
+
+	pos := mkv.segmentPosition()
+	if mkv.seekable && f.Keyframe {
+		mkv.cues = append(mkv.cues, cuePoint{tc, f.Track, pos})
+	}
+	children := []ebml.Object{
+		Timecode(ebml.Uint(tc)),
+		Position(ebml.Uint(pos)),
+	}
+	if mkv.clusterSize > 0 {
+		children = append(children, PrevSize(ebml.Uint(mkv.clusterSize)))
+	}
+	children = append(children, BlockGroup(group...))
+	cluster := Cluster(children...)
+	mkv.enc.Emit(cluster)
+	mkv.clusterSize = cluster.Size()
+
+	if mkv.frames == 0 {
+		mkv.start = f.Timecode
+	}
+	mkv.frames++
+	dur := f.Duration
+	if dur == 0 {
+		// Frames without a duration last for the track's default
+		// duration.
+		for _, t := range mkv.Tracks {
+			if t.Number == f.Track {
+				dur = t.DefaultDuration
+			}
+		}
+	}
+	if end := f.Timecode + dur; end > mkv.end {
+		mkv.end = end
+	}
+	return mkv.enc.Err
+}
+
+// Consumed returns the position up to which the reader of the output
+// has consumed the file, for use with spliceable frames. It may be
+// called concurrently with the other methods, but only after Write
+// returned.
+func (mkv *MKV) Consumed() (int, error) {
+	return mkv.enc.Consumed()
+}
+
+// Frames returns the number of frames written so far.
+func (mkv *MKV) Frames() int {
+	return mkv.frames
+}
+
+// End returns the time at which the last frame written so far ends.
+func (mkv *MKV) End() time.Duration {
+	return mkv.end
+}
+
+// AddChapter adds a chapter, to be written by Close.
+func (mkv *MKV) AddChapter(ch Chapter) {
+	mkv.chapters = append(mkv.chapters, ch)
+}
+
+func (mkv *MKV) generateChapters() ebml.Element {
+	atoms := []ebml.Object{EditionUID(ebml.Uint(1))}
+	for i, ch := range mkv.chapters {
+		atoms = append(atoms, ChapterAtom(
+			ChapterUID(ebml.Uint(i+1)),
+			// Unlike everything else, chapter times aren't
+			// scaled by TimecodeScale.
+			ChapterTimeStart(ebml.Uint(ch.Start)),
+			ChapterDisplay(
+				ChapString(ebml.UTF8(ch.Title)),
+				ChapLanguage(ebml.String("eng")))))
+	}
+	return Chapters(EditionEntry(atoms...))
+}
+
+func generateCues(cues []cuePoint) ebml.Element {
+	var points []ebml.Object
+	for _, cue := range cues {
+		points = append(points, CuePoint(
+			CueTime(ebml.Uint(cue.time)),
+			CueTrackPositions(
+				CueTrack(ebml.Uint(cue.track)),
+				CueClusterPosition(ebml.Uint(cue.pos)))))
+	}
+	return Cues(points...)
+}
+
+func generateSeekHead(entries []seekEntry) ebml.Element {
+	var seeks []ebml.Object
+	for _, s := range entries {
+		seeks = append(seeks, Seek(
+			SeekID(ebml.Binary(s.id.Bytes())),
+			SeekPosition(ebml.Uint(s.pos))))
+	}
+	return SeekHead(seeks...)
+}
+
+// Close finalizes the file. It writes the Chapters and, if the output
+// is seekable, the Cues, SeekHead, Duration and the final size of the
+// segment. It does not close the underlying writer.
+func (mkv *MKV) Close() error {
+	if mkv.enc == nil {
+		return errors.New("matroska: Close called before Write")
+	}
+	var chapters ebml.Element
+	front := false
+	if len(mkv.chapters) > 0 {
+		chapters = mkv.generateChapters()
+		size := chapters.Size()
+		// The rest of the reserved space has to be filled with a
+		// Void, which is at least 2 bytes.
+		front = mkv.seekable && (size == chaptersSize || size <= chaptersSize-2)
+		if !front {
+			mkv.markSeek(Chapters)
+			mkv.enc.Emit(chapters)
+		}
+	}
+	if !mkv.seekable {
+		return mkv.enc.Err
+	}
+
+	if len(mkv.cues) > 0 {
+		mkv.markSeek(Cues)
+		mkv.enc.Emit(generateCues(mkv.cues))
+	}
+	end := mkv.enc.Position()
+
+	if front {
+		mkv.seeks = append(mkv.seeks, seekEntry{Chapters, mkv.chapterSpace - mkv.segment.Data})
+		mkv.enc.Seek(mkv.chapterSpace)
+		mkv.enc.Emit(chapters)
+		if rest := chaptersSize - chapters.Size(); rest > 0 {
+			mkv.enc.EmitVoid(rest)
+		}
+	}
+
+	seekHead := generateSeekHead(mkv.seeks)
+	mkv.enc.Seek(mkv.seekHead)
+	mkv.enc.Emit(seekHead)
+	mkv.enc.EmitVoid(seekHeadSize - seekHead.Size())
+
+	if mkv.duration != 0 {
+		mkv.enc.Seek(mkv.duration)
+		mkv.enc.Emit(Duration(ebml.Float64((mkv.end - mkv.start) / mkv.timecodeScale())))
+	}
+
+	var zero [16]byte
+	if mkv.nextUID != 0 && mkv.NextUID == zero {
+		mkv.enc.Seek(mkv.nextUID)
+		mkv.enc.EmitVoid(mkv.nextUIDSize)
+	}
+
+	mkv.enc.Seek(end)
+	mkv.enc.FixSize(mkv.segment, end-mkv.segment.Data)
+	return mkv.enc.Err
 }
 
 func _() {
@@ -0,0 +1,693 @@
+package matroska
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska/ebml"
+)
+
+// Reader reads Matroska files, such as the ones written by MKV. It
+// reads the file sequentially and never seeks, so it works on pipes
+// and on files that are still being written.
+//
+// Lacing and content encodings other than zlib compression aren't
+// supported.
+type Reader struct {
+	// Segment describes the segment: its Info, Tracks, Tags and
+	// Attachments. NewReader reads everything that precedes the first
+	// cluster. Tags that follow the clusters are added by ReadPacket
+	// once it encounters them.
+	Segment  MKV
+	Chapters []Chapter
+	Cues     []Cue
+	// SegmentOffset is the position of the segment's data in the
+	// file. All positions stored in the file, such as those in Cues,
+	// are relative to it.
+	SegmentOffset int64
+	// SegmentSize is the size of the segment, or ebml.UnknownSize.
+	SegmentSize int64
+	// TopLevel holds the headers of all children of the segment
+	// read so far, other than clusters.
+	TopLevel []ebml.Header
+	// Raw, if set, makes ReadPacket return frames as they are stored,
+	// without undoing content compression.
+	Raw bool
+
+	dec     *ebml.Decoder
+	segment ebml.Header
+	// pending is a header that has been read but belongs to the
+	// caller of whoever read it, for example the element following
+	// a cluster of unknown size.
+	pending *ebml.Header
+	cluster *ebml.Header
+	tc      int64
+	// complete is the position after the last complete element.
+	complete int64
+}
+
+// A Cue is an entry of the index.
+type Cue struct {
+	Time            time.Duration
+	Track           int
+	ClusterPosition int64
+}
+
+// A Packet is a frame as read from a file, along with the location
+// of the block that stored it.
+type Packet struct {
+	Frame
+	// Cluster is the position of the cluster that contains the
+	// block, and Offset the position of the block itself, both
+	// relative to the beginning of the file.
+	Cluster int64
+	Offset  int64
+	// End is the position of the first byte after the block.
+	End int64
+}
+
+var errUnsupported = errors.New("matroska: unsupported feature")
+
+// NewReader reads the EBML header and the segment's metadata up to
+// the first cluster.
+func NewReader(r io.Reader) (*Reader, error) {
+	mr := &Reader{dec: ebml.NewDecoder(r)}
+	h, err := mr.dec.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !h.Is(ebml.EBML) {
+		return nil, errors.New("matroska: not an EBML file")
+	}
+	var docType string
+	err = mr.children(h, func(h ebml.Header) error {
+		if h.Is(ebml.DocType) {
+			var err error
+			docType, err = mr.dec.String(h)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, fmt.Errorf("matroska: unsupported document type %q", docType)
+	}
+
+	for {
+		h, err = mr.dec.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if h.Is(Segment) {
+			break
+		}
+		if err := mr.dec.Skip(h); err != nil {
+			return nil, err
+		}
+	}
+	mr.segment = h
+	mr.SegmentOffset = h.Data
+	mr.SegmentSize = h.Size
+	mr.complete = h.Data
+
+	for {
+		h, err := mr.nextTopLevel()
+		if err == io.EOF {
+			return mr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Is(Cluster) {
+			mr.pending = &h
+			return mr, nil
+		}
+		if err := mr.topLevel(h); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// TimecodeScale returns the segment's timecode scale.
+func (mr *Reader) TimecodeScale() time.Duration {
+	return mr.Segment.timecodeScale()
+}
+
+// nextTopLevel returns the next child of the segment. It returns
+// io.EOF at the end of the segment.
+func (mr *Reader) nextTopLevel() (ebml.Header, error) {
+	if mr.pending != nil {
+		h := *mr.pending
+		mr.pending = nil
+		return h, nil
+	}
+	if mr.segment.Size != ebml.UnknownSize && mr.dec.Position() >= mr.segment.End() {
+		return ebml.Header{}, io.EOF
+	}
+	h, err := mr.dec.Next()
+	if err == io.EOF && mr.segment.Size != ebml.UnknownSize {
+		err = io.ErrUnexpectedEOF
+	}
+	return h, err
+}
+
+// topLevel reads a child of the segment other than a cluster.
+func (mr *Reader) topLevel(h ebml.Header) error {
+	var err error
+	switch {
+	case h.Is(Info):
+		err = mr.readInfo(h)
+	case h.Is(Tracks):
+		err = mr.readTracks(h)
+	case h.Is(Tags):
+		err = mr.readTags(h)
+	case h.Is(Chapters):
+		err = mr.readChapters(h)
+	case h.Is(Cues):
+		err = mr.readCues(h)
+	case h.Is(Attachments):
+		err = mr.readAttachments(h)
+	}
+	if err != nil {
+		return err
+	}
+	if err := mr.dec.Skip(h); err != nil {
+		return err
+	}
+	mr.TopLevel = append(mr.TopLevel, h)
+	mr.complete = h.End()
+	return nil
+}
+
+// Complete returns the position after the last complete child of
+// the segment read so far. For clusters of unknown size, complete
+// blocks count as well. After ReadPacket returned
+// io.ErrUnexpectedEOF, this is where the file can be cut to remove
+// the incomplete rest.
+func (mr *Reader) Complete() int64 {
+	return mr.complete
+}
+
+// isTopLevel reports whether h is a child of the segment. These
+// mark the end of clusters of unknown size.
+func isTopLevel(h ebml.Header) bool {
+	for _, id := range []ebml.ElementID{Cluster, Cues, Tags, Chapters, Info, Tracks, SeekHead, Attachments} {
+		if h.Is(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// children calls fn for each child of parent, and skips whatever fn
+// doesn't read. parent must have a known size.
+func (mr *Reader) children(parent ebml.Header, fn func(h ebml.Header) error) error {
+	if parent.Size == ebml.UnknownSize {
+		return fmt.Errorf("matroska: element %x has unknown size", parent.ID)
+	}
+	for mr.dec.Position() < parent.End() {
+		h, err := mr.dec.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if h.Size == ebml.UnknownSize || h.End() > parent.End() {
+			return fmt.Errorf("matroska: element %x at offset %d exceeds its parent", h.ID, h.Offset)
+		}
+		if err := fn(h); err != nil {
+			return err
+		}
+		if err := mr.dec.Skip(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mr *Reader) uid(h ebml.Header) ([16]byte, error) {
+	var uid [16]byte
+	b, err := mr.dec.Bytes(h)
+	copy(uid[:], b)
+	return uid, err
+}
+
+func (mr *Reader) readInfo(h ebml.Header) error {
+	var duration float64
+	seg := &mr.Segment
+	err := mr.children(h, func(h ebml.Header) error {
+		var err error
+		var v uint64
+		switch {
+		case h.Is(SegmentUID):
+			seg.SegmentUID, err = mr.uid(h)
+		case h.Is(PrevUID):
+			seg.PrevUID, err = mr.uid(h)
+		case h.Is(NextUID):
+			seg.NextUID, err = mr.uid(h)
+		case h.Is(SegmentFamily):
+			var uid [16]byte
+			uid, err = mr.uid(h)
+			seg.SegmentFamily = append(seg.SegmentFamily, uid)
+		case h.Is(SegmentFilename):
+			seg.SegmentFilename, err = mr.dec.String(h)
+		case h.Is(PrevFilename):
+			seg.PrevFilename, err = mr.dec.String(h)
+		case h.Is(NextFilename):
+			seg.NextFilename, err = mr.dec.String(h)
+		case h.Is(TimecodeScale):
+			v, err = mr.dec.Uint(h)
+			seg.TimecodeScale = time.Duration(v)
+		case h.Is(Duration):
+			duration, err = mr.dec.Float(h)
+		case h.Is(DateUTC):
+			seg.Date, err = mr.dec.Date(h)
+		case h.Is(Title):
+			seg.Title, err = mr.dec.String(h)
+		case h.Is(WritingApp):
+			seg.WritingApp, err = mr.dec.String(h)
+		}
+		return err
+	})
+	seg.Duration = time.Duration(duration * float64(seg.timecodeScale()))
+	return err
+}
+
+func (mr *Reader) readTracks(h ebml.Header) error {
+	return mr.children(h, func(h ebml.Header) error {
+		if !h.Is(TrackEntry) {
+			return nil
+		}
+		var t Track
+		err := mr.children(h, func(h ebml.Header) error {
+			var err error
+			var v uint64
+			switch {
+			case h.Is(TrackNumber):
+				v, err = mr.dec.Uint(h)
+				t.Number = int(v)
+			case h.Is(TrackUID):
+				t.UID, err = mr.dec.Uint(h)
+			case h.Is(TrackType):
+				v, err = mr.dec.Uint(h)
+				t.Type = TrackKind(v)
+			case h.Is(CodecID):
+				t.CodecID, err = mr.dec.String(h)
+			case h.Is(CodecPrivate):
+				t.CodecPrivate, err = mr.dec.Bytes(h)
+			case h.Is(DefaultDuration):
+				v, err = mr.dec.Uint(h)
+				t.DefaultDuration = time.Duration(v)
+			case h.Is(Video):
+				t.Video = &VideoSettings{}
+				err = mr.readVideo(h, t.Video)
+			case h.Is(ContentEncodings):
+				t.Compression, err = mr.readContentEncodings(h)
+			}
+			return err
+		})
+		mr.Segment.Tracks = append(mr.Segment.Tracks, t)
+		return err
+	})
+}
+
+func (mr *Reader) readVideo(h ebml.Header, v *VideoSettings) error {
+	return mr.children(h, func(h ebml.Header) error {
+		var err error
+		var n uint64
+		switch {
+		case h.Is(PixelWidth):
+			n, err = mr.dec.Uint(h)
+			v.PixelWidth = int(n)
+		case h.Is(PixelHeight):
+			n, err = mr.dec.Uint(h)
+			v.PixelHeight = int(n)
+		case h.Is(ColourSpace):
+			v.ColourSpace, err = mr.dec.Bytes(h)
+		case h.Is(Colour):
+			err = mr.children(h, func(h ebml.Header) error {
+				if h.Is(BitsPerChannel) {
+					n, err := mr.dec.Uint(h)
+					v.BitsPerChannel = int(n)
+					return err
+				}
+				return nil
+			})
+		}
+		return err
+	})
+}
+
+func (mr *Reader) readContentEncodings(h ebml.Header) (Compression, error) {
+	c := NoCompression
+	err := mr.children(h, func(h ebml.Header) error {
+		if !h.Is(ContentEncoding) {
+			return nil
+		}
+		if c != NoCompression {
+			// We only support a single encoding.
+			return errUnsupported
+		}
+		var typ, scope, algo uint64 = 0, 1, 0
+		err := mr.children(h, func(h ebml.Header) error {
+			var err error
+			switch {
+			case h.Is(ContentEncodingType):
+				typ, err = mr.dec.Uint(h)
+			case h.Is(ContentEncodingScope):
+				scope, err = mr.dec.Uint(h)
+			case h.Is(ContentCompression):
+				err = mr.children(h, func(h ebml.Header) error {
+					var err error
+					if h.Is(ContentCompAlgo) {
+						algo, err = mr.dec.Uint(h)
+					}
+					return err
+				})
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Only zlib compression of frame contents
+		if typ != 0 || scope != 1 || algo != 0 {
+			return errUnsupported
+		}
+		c = Zlib
+		return nil
+	})
+	return c, err
+}
+
+func (mr *Reader) readTags(h ebml.Header) error {
+	if mr.Segment.Tags == nil {
+		mr.Segment.Tags = map[string]string{}
+	}
+	return mr.children(h, func(h ebml.Header) error {
+		if !h.Is(Tag) {
+			return nil
+		}
+		return mr.children(h, func(h ebml.Header) error {
+			if !h.Is(SimpleTag) {
+				return nil
+			}
+			var name, value string
+			err := mr.children(h, func(h ebml.Header) error {
+				var err error
+				switch {
+				case h.Is(TagName):
+					name, err = mr.dec.String(h)
+				case h.Is(TagString):
+					value, err = mr.dec.String(h)
+				}
+				return err
+			})
+			if name != "" {
+				mr.Segment.Tags[name] = value
+			}
+			return err
+		})
+	})
+}
+
+func (mr *Reader) readChapters(h ebml.Header) error {
+	return mr.children(h, func(h ebml.Header) error {
+		if !h.Is(EditionEntry) {
+			return nil
+		}
+		return mr.children(h, func(h ebml.Header) error {
+			if !h.Is(ChapterAtom) {
+				return nil
+			}
+			var ch Chapter
+			err := mr.children(h, func(h ebml.Header) error {
+				var err error
+				switch {
+				case h.Is(ChapterTimeStart):
+					var v uint64
+					v, err = mr.dec.Uint(h)
+					ch.Start = time.Duration(v)
+				case h.Is(ChapterDisplay):
+					err = mr.children(h, func(h ebml.Header) error {
+						var err error
+						if h.Is(ChapString) && ch.Title == "" {
+							ch.Title, err = mr.dec.String(h)
+						}
+						return err
+					})
+				}
+				return err
+			})
+			mr.Chapters = append(mr.Chapters, ch)
+			return err
+		})
+	})
+}
+
+func (mr *Reader) readCues(h ebml.Header) error {
+	ts := mr.TimecodeScale()
+	return mr.children(h, func(h ebml.Header) error {
+		if !h.Is(CuePoint) {
+			return nil
+		}
+		var t uint64
+		var cues []Cue
+		err := mr.children(h, func(h ebml.Header) error {
+			var err error
+			switch {
+			case h.Is(CueTime):
+				t, err = mr.dec.Uint(h)
+			case h.Is(CueTrackPositions):
+				var cue Cue
+				err = mr.children(h, func(h ebml.Header) error {
+					var err error
+					var v uint64
+					switch {
+					case h.Is(CueTrack):
+						v, err = mr.dec.Uint(h)
+						cue.Track = int(v)
+					case h.Is(CueClusterPosition):
+						v, err = mr.dec.Uint(h)
+						cue.ClusterPosition = int64(v)
+					}
+					return err
+				})
+				cues = append(cues, cue)
+			}
+			return err
+		})
+		for _, cue := range cues {
+			cue.Time = time.Duration(t) * ts
+			mr.Cues = append(mr.Cues, cue)
+		}
+		return err
+	})
+}
+
+func (mr *Reader) readAttachments(h ebml.Header) error {
+	return mr.children(h, func(h ebml.Header) error {
+		if !h.Is(AttachedFile) {
+			return nil
+		}
+		var a Attachment
+		err := mr.children(h, func(h ebml.Header) error {
+			var err error
+			switch {
+			case h.Is(FileUID):
+				a.UID, err = mr.dec.Uint(h)
+			case h.Is(FileName):
+				a.Name, err = mr.dec.String(h)
+			case h.Is(FileMimeType):
+				a.MIMEType, err = mr.dec.String(h)
+			case h.Is(FileDescription):
+				a.Description, err = mr.dec.String(h)
+			case h.Is(FileData):
+				a.Data, err = mr.dec.Bytes(h)
+			}
+			return err
+		})
+		mr.Segment.Attachments = append(mr.Segment.Attachments, a)
+		return err
+	})
+}
+
+func (mr *Reader) track(n int) *Track {
+	for i := range mr.Segment.Tracks {
+		if mr.Segment.Tracks[i].Number == n {
+			return &mr.Segment.Tracks[i]
+		}
+	}
+	return nil
+}
+
+// ReadPacket returns the next frame. Metadata following the clusters
+// is read as it is encountered. At the end of the segment, ReadPacket
+// returns io.EOF. If the file ends in the middle of an element, it
+// returns io.ErrUnexpectedEOF.
+func (mr *Reader) ReadPacket() (Packet, error) {
+	for {
+		if mr.cluster == nil {
+			h, err := mr.nextTopLevel()
+			if err != nil {
+				return Packet{}, err
+			}
+			if !h.Is(Cluster) {
+				if err := mr.topLevel(h); err != nil {
+					return Packet{}, err
+				}
+				continue
+			}
+			mr.cluster = &h
+			mr.tc = 0
+		}
+
+		c := *mr.cluster
+		if c.Size != ebml.UnknownSize && mr.dec.Position() >= c.End() {
+			mr.cluster = nil
+			mr.complete = c.End()
+			continue
+		}
+		h, err := mr.dec.Next()
+		if err == io.EOF && c.Size == ebml.UnknownSize && mr.segment.Size == ebml.UnknownSize {
+			// A live stream that ended between two blocks
+			mr.complete = mr.dec.Position()
+			return Packet{}, io.EOF
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Packet{}, err
+		}
+		if c.Size == ebml.UnknownSize && isTopLevel(h) {
+			mr.cluster = nil
+			mr.pending = &h
+			mr.complete = h.Offset
+			continue
+		}
+		switch {
+		case h.Is(Timecode):
+			v, err := mr.dec.Uint(h)
+			if err != nil {
+				return Packet{}, err
+			}
+			mr.tc = int64(v)
+		case h.Is(SimpleBlock):
+			data, err := mr.dec.Bytes(h)
+			if err != nil {
+				return Packet{}, err
+			}
+			b, err := mr.parseBlock(data, true)
+			b.Cluster, b.Offset, b.End = c.Offset, h.Offset, h.End()
+			if c.Size == ebml.UnknownSize {
+				mr.complete = h.End()
+			}
+			return b, err
+		case h.Is(BlockGroup):
+			b, err := mr.readBlockGroup(h)
+			b.Cluster, b.Offset, b.End = c.Offset, h.Offset, h.End()
+			if c.Size == ebml.UnknownSize {
+				mr.complete = h.End()
+			}
+			return b, err
+		}
+		if err := mr.dec.Skip(h); err != nil {
+			return Packet{}, err
+		}
+	}
+}
+
+func (mr *Reader) readBlockGroup(h ebml.Header) (Packet, error) {
+	var data []byte
+	var duration uint64
+	hasDuration := false
+	reference := false
+	err := mr.children(h, func(h ebml.Header) error {
+		var err error
+		switch {
+		case h.Is(Block):
+			data, err = mr.dec.Bytes(h)
+		case h.Is(BlockDuration):
+			duration, err = mr.dec.Uint(h)
+			hasDuration = true
+		case h.Is(ReferenceBlock):
+			reference = true
+		}
+		return err
+	})
+	if err != nil {
+		return Packet{}, err
+	}
+	if data == nil {
+		return Packet{}, fmt.Errorf("matroska: BlockGroup at offset %d has no Block", h.Offset)
+	}
+	b, err := mr.parseBlock(data, false)
+	if err != nil {
+		return Packet{}, err
+	}
+	b.Keyframe = !reference
+	if hasDuration {
+		b.Duration = time.Duration(duration) * mr.TimecodeScale()
+	}
+	return b, nil
+}
+
+// parseBlock parses the contents of a Block or SimpleBlock.
+func (mr *Reader) parseBlock(data []byte, simple bool) (Packet, error) {
+	// Track number, a varint that is at most 8 bytes long
+	if len(data) < 1 || data[0] == 0 {
+		return Packet{}, ebml.ErrInvalid
+	}
+	n := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if len(data) < n+3 {
+		return Packet{}, ebml.ErrInvalid
+	}
+	track := uint64(data[0]) &^ (0x80 >> uint(n-1))
+	for _, c := range data[1:n] {
+		track = track<<8 | uint64(c)
+	}
+	rel := int16(uint16(data[n])<<8 | uint16(data[n+1]))
+	flags := data[n+2]
+	if flags&0x06 != 0 {
+		return Packet{}, fmt.Errorf("%s: lacing", errUnsupported)
+	}
+
+	ts := mr.TimecodeScale()
+	b := Packet{Frame: Frame{
+		Track:    int(track),
+		Timecode: time.Duration(mr.tc+int64(rel)) * ts,
+		Keyframe: simple && flags&0x80 != 0,
+		Data:     data[n+3:],
+	}}
+	t := mr.track(b.Track)
+	if t == nil {
+		return Packet{}, fmt.Errorf("matroska: block refers to unknown track %d", track)
+	}
+	b.Duration = t.DefaultDuration
+	if t.Compression == Zlib && !mr.Raw {
+		zr, err := zlib.NewReader(bytes.NewReader(b.Data))
+		if err != nil {
+			return Packet{}, err
+		}
+		b.Data, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return Packet{}, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,222 @@
+package matroska
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska/ebml"
+)
+
+// ErrNotRepairable is returned by Repair for files that can't be
+// repaired in place, such as files that weren't written by MKV to a
+// seekable output.
+var ErrNotRepairable = errors.New("matroska: file can't be repaired in place")
+
+// RepairResult describes what Repair did.
+type RepairResult struct {
+	// Frames is the number of frames that were kept, and Duration
+	// the time they cover.
+	Frames   int
+	Duration time.Duration
+	// Dropped is the number of bytes that were cut off.
+	Dropped int64
+	// Intact is set if the file was complete and didn't need any
+	// changes.
+	Intact bool
+}
+
+// Repair finalizes a file that wasn't closed properly, for example
+// because the program writing it crashed. It cuts off the incomplete
+// cluster at the end, appends Cues and, if there were any at the end
+// of the file, the Chapters, and fills in the SeekHead, the Duration
+// and the size of the segment, using the space that MKV reserves for
+// them in seekable files.
+func Repair(f *os.File) (RepairResult, error) {
+	var res RepairResult
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return res, err
+	}
+	mr, err := NewReader(f)
+	if err != nil {
+		return res, err
+	}
+	mr.Raw = true
+
+	type frame struct {
+		cluster  int64
+		track    int
+		keyframe bool
+		start    time.Duration
+		end      time.Duration
+	}
+	var frames []frame
+	var readErr error
+	for {
+		p, err := mr.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				// Whatever follows the error, be it a partially
+				// written cluster or garbage, is lost.
+				readErr = err
+			}
+			break
+		}
+		frames = append(frames, frame{p.Cluster, p.Track, p.Keyframe, p.Timecode, p.Timecode + p.Duration})
+	}
+	if readErr == nil && mr.SegmentSize != ebml.UnknownSize {
+		res.Frames = len(frames)
+		res.Intact = true
+		return res, nil
+	}
+
+	// Only keep frames whose clusters are complete, and drop any
+	// index that follows them, as we're going to rebuild it.
+	cut := mr.Complete()
+	for len(frames) > 0 && frames[len(frames)-1].cluster >= cut {
+		frames = frames[:len(frames)-1]
+	}
+	last := cut
+	if len(frames) > 0 {
+		last = frames[len(frames)-1].cluster
+	}
+	trailingChapters := false
+	for _, h := range mr.TopLevel {
+		if h.Offset < last {
+			continue
+		}
+		switch {
+		case h.Is(Chapters):
+			trailingChapters = true
+		case h.Is(Cues), h.Is(SeekHead), h.Is(ebml.Void):
+		default:
+			return res, ErrNotRepairable
+		}
+		if h.Offset < cut {
+			cut = h.Offset
+		}
+	}
+
+	// The SeekHead goes into the space reserved for it, which is
+	// either still a Void or holds the SeekHead of an earlier Close.
+	if len(mr.TopLevel) == 0 {
+		return res, ErrNotRepairable
+	}
+	first := mr.TopLevel[0]
+	if first.Offset != mr.SegmentOffset || !(first.Is(ebml.Void) || first.Is(SeekHead)) {
+		return res, ErrNotRepairable
+	}
+	spaceEnd := first.End()
+	if first.Is(SeekHead) && len(mr.TopLevel) > 1 {
+		if next := mr.TopLevel[1]; next.Is(ebml.Void) && next.Offset == spaceEnd {
+			spaceEnd = next.End()
+		}
+	}
+	space := int(spaceEnd - first.Offset)
+
+	ts := mr.TimecodeScale()
+	var cues []cuePoint
+	var end time.Duration
+	for _, fr := range frames {
+		if fr.keyframe {
+			cues = append(cues, cuePoint{uint64(fr.start / ts), fr.track, int(fr.cluster - mr.SegmentOffset)})
+		}
+		if fr.end > end {
+			end = fr.end
+		}
+	}
+	if len(frames) > 0 {
+		res.Duration = end - frames[0].start
+	}
+	var tail []ebml.Element
+	var seeks []seekEntry
+	for _, h := range mr.TopLevel {
+		if h.Offset >= cut {
+			break
+		}
+		for _, id := range []ebml.ElementID{Info, Tracks, Tags, Chapters, Attachments} {
+			if h.Is(id) {
+				seeks = append(seeks, seekEntry{id, int(h.Offset - mr.SegmentOffset)})
+			}
+		}
+	}
+	pos := int(cut - mr.SegmentOffset)
+	if len(cues) > 0 {
+		tail = append(tail, generateCues(cues))
+		seeks = append(seeks, seekEntry{Cues, pos})
+		pos += tail[len(tail)-1].Size()
+	}
+	if trailingChapters && len(mr.Chapters) > 0 {
+		tail = append(tail, (&MKV{chapters: mr.Chapters}).generateChapters())
+		seeks = append(seeks, seekEntry{Chapters, pos})
+	}
+	seekHead := generateSeekHead(seeks)
+	if size := seekHead.Size(); size != space && size > space-2 {
+		return res, ErrNotRepairable
+	}
+
+	// Find the Duration placeholder, if there is one.
+	var duration int64
+	for _, h := range mr.TopLevel {
+		if !h.Is(Info) || h.Offset >= cut {
+			continue
+		}
+		dec := ebml.NewDecoder(io.NewSectionReader(f, h.Data, h.Size))
+		for {
+			child, err := dec.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return res, err
+			}
+			if child.Is(Duration) && child.Size == 8 {
+				duration = h.Data + child.Offset
+			}
+			if err := dec.Skip(child); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return res, err
+	}
+	res.Frames = len(frames)
+	res.Dropped = fi.Size() - cut
+
+	if err := f.Truncate(cut); err != nil {
+		return res, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return res, err
+	}
+	enc := ebml.NewEncoder(f)
+	enc.Seek(int(cut))
+	for _, e := range tail {
+		enc.Emit(e)
+	}
+	size := enc.Position()
+
+	enc.Seek(int(first.Offset))
+	enc.Emit(seekHead)
+	if rest := space - seekHead.Size(); rest > 0 {
+		enc.EmitVoid(rest)
+	}
+	if duration != 0 && len(frames) > 0 {
+		enc.Seek(int(duration))
+		enc.Emit(Duration(ebml.Float64(res.Duration / ts)))
+	}
+
+	// The segment's ID is 4 bytes long.
+	segment := ebml.Reference{
+		ID:   int(mr.segment.Offset),
+		Size: int(mr.segment.Offset) + 4,
+		Data: int(mr.segment.Data),
+	}
+	enc.Seek(size)
+	enc.FixSize(segment, size-segment.Data)
+	return res, enc.Err
+}
@@ -21,19 +21,25 @@ type Segment struct {
 	Size int
 }
 
+// shmid_ds mirrors the kernel's struct shmid64_ds on 64-bit
+// architectures.
 type shmid_ds struct {
 	_ struct {
-		key  int
-		uid  uint
-		gid  uint
-		cuid uint
-		cgid uint
-		mode uint
+		key  int32
+		uid  uint32
+		gid  uint32
+		cuid uint32
+		cgid uint32
+		mode uint32
 		seq  uint16
+		_    uint16
+		_    [2]uint
 	}
-	Size int
-	_    [256]byte
-	_    [2]uintptr
+	Size   int
+	_      [3]int // atime, dtime, ctime
+	_      [2]int32
+	Nattch uint
+	_      [2]uint
 }
 
 func shmget(size int, flags int, perm int) (int, error) {
@@ -61,6 +67,15 @@ func shmsize(id int) (int, error) {
 	return ds.Size, nil
 }
 
+func shmnattch(id int) (int, error) {
+	ds := new(shmid_ds)
+	err := shmctl(id, IPC_STAT, ds)
+	if err != nil {
+		return 0, err
+	}
+	return int(ds.Nattch), nil
+}
+
 func shmdt(addr unsafe.Pointer) error {
 	_, _, err := unix.Syscall(unix.SYS_SHMDT, uintptr(addr), uintptr(0), uintptr(0))
 	if err != 0 {
@@ -81,6 +96,34 @@ func Create(size int) (*Segment, error) {
 	return OpenSegment(size, (IPC_CREAT | IPC_EXCL), 0600)
 }
 
+// CreateShared creates a new segment, attaches it and calls share,
+// which should cause other processes (such as the X server) to attach
+// the segment, too. Afterwards, the segment is marked for
+// destruction. The kernel frees it once all processes have detached
+// from it, which happens automatically when they exit. This way, the
+// segment can't outlive its users, even if they crash.
+func CreateShared(size int, share func(seg *Segment) error) (*Segment, unsafe.Pointer, error) {
+	seg, err := Create(size)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := seg.Attach()
+	if err != nil {
+		seg.Destroy()
+		return nil, nil, err
+	}
+	if err := share(seg); err != nil {
+		seg.Detach(addr)
+		seg.Destroy()
+		return nil, nil, err
+	}
+	if err := seg.Destroy(); err != nil {
+		seg.Detach(addr)
+		return nil, nil, err
+	}
+	return seg, addr, nil
+}
+
 func Open(id int) (*Segment, error) {
 	sz, err := shmsize(id)
 	if err != nil {
@@ -126,3 +169,9 @@ func (self *Segment) Detach(addr unsafe.Pointer) error {
 func (self *Segment) Destroy() error {
 	return DestroySegment(self.ID)
 }
+
+// Attachments returns the number of processes that have attached the
+// segment.
+func (self *Segment) Attachments() (int, error) {
+	return shmnattch(self.ID)
+}
@@ -0,0 +1,86 @@
+package shm
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func bytesAt(addr unsafe.Pointer, size int) []byte {
+	return unsafe.Slice((*byte)(addr), size)
+}
+
+func TestLifecycle(t *testing.T) {
+	const size = 3 * 4096
+	seg, err := Create(size)
+	if err != nil {
+		t.Skip("SysV shared memory is not available:", err)
+	}
+	if seg.Size != size {
+		t.Errorf("got size %d, want %d", seg.Size, size)
+	}
+	addr, err := seg.Attach()
+	if err != nil {
+		seg.Destroy()
+		t.Fatal(err)
+	}
+	b := bytesAt(addr, size)
+	for i := range b {
+		b[i] = byte(i)
+	}
+
+	if err := seg.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	// The segment stays usable until the last process detaches from
+	// it.
+	for i := range b {
+		if b[i] != byte(i) {
+			t.Fatalf("byte %d is %d after destroying the segment, want %d", i, b[i], byte(i))
+		}
+	}
+	if n, err := seg.Attachments(); err != nil || n != 1 {
+		t.Errorf("got %d attachments (err %v), want 1", n, err)
+	}
+
+	if err := seg.Detach(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(seg.ID); err == nil {
+		t.Errorf("segment %d still exists after detaching", seg.ID)
+	}
+}
+
+func TestCreateShared(t *testing.T) {
+	const size = 4096
+	var other unsafe.Pointer
+	seg, addr, err := CreateShared(size, func(seg *Segment) error {
+		// Stand in for the X server
+		var err error
+		other, err = seg.Attach()
+		return err
+	})
+	if err != nil {
+		t.Skip("SysV shared memory is not available:", err)
+	}
+	if n, err := seg.Attachments(); err != nil || n != 2 {
+		t.Errorf("got %d attachments (err %v), want 2", n, err)
+	}
+
+	bytesAt(addr, size)[42] = 42
+	if v := bytesAt(other, size)[42]; v != 42 {
+		t.Errorf("other mapping has %d, want 42", v)
+	}
+
+	if err := seg.Detach(addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(seg.ID); err != nil {
+		t.Errorf("segment went away while still attached: %s", err)
+	}
+	if err := seg.Detach(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(seg.ID); err == nil {
+		t.Errorf("segment %d still exists after all processes detached", seg.ID)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/xgb/composite"
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/ewmh"
+	"github.com/BurntSushi/xgbutil/icccm"
+)
+
+// ScreenInfo lists what can be captured, as printed by the list
+// subcommand.
+type ScreenInfo struct {
+	Windows  []WindowInfo `json:"windows"`
+	Monitors []Monitor    `json:"monitors"`
+	// Composite is set if the COMPOSITE extension is available, which
+	// capturing windows requires. Any window can be redirected with
+	// it, as automatic redirections by several clients don't
+	// conflict.
+	Composite bool `json:"composite"`
+}
+
+// WindowInfo describes a client window. The position is relative to
+// the root window. PID is 0 if the window doesn't set _NET_WM_PID.
+type WindowInfo struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	Instance string `json:"instance"`
+	Class    string `json:"class"`
+	PID      int    `json:"pid"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Depth    int    `json:"depth"`
+	Visual   int    `json:"visual"`
+}
+
+// listWindows returns the viewable client windows, from the bottom to
+// the top of the stack.
+func listWindows(xu *xgbutil.XUtil) ([]WindowInfo, error) {
+	conn := xu.Conn()
+	tree, err := xproto.QueryTree(conn, xu.RootWin()).Reply()
+	if err != nil {
+		return nil, err
+	}
+	wins := []WindowInfo{}
+	for _, child := range tree.Children {
+		attrs, err := xproto.GetWindowAttributes(conn, child).Reply()
+		if err != nil || attrs.MapState != xproto.MapStateViewable || attrs.OverrideRedirect {
+			// Override-redirect windows are menus and the like, not
+			// clients.
+			continue
+		}
+		w := clientWindow(xu, child)
+		if w != child {
+			attrs, err = xproto.GetWindowAttributes(conn, w).Reply()
+			if err != nil || attrs.MapState != xproto.MapStateViewable {
+				continue
+			}
+		}
+		geom, err := xproto.GetGeometry(conn, xproto.Drawable(w)).Reply()
+		if err != nil {
+			continue
+		}
+		pos, err := xproto.TranslateCoordinates(conn, w, xu.RootWin(), 0, 0).Reply()
+		if err != nil {
+			continue
+		}
+		info := WindowInfo{
+			ID:     int(w),
+			Title:  windowTitle(xu, w),
+			X:      int(pos.DstX),
+			Y:      int(pos.DstY),
+			Width:  int(geom.Width),
+			Height: int(geom.Height),
+			Depth:  int(geom.Depth),
+			Visual: int(attrs.Visual),
+		}
+		if class, err := icccm.WmClassGet(xu, w); err == nil {
+			info.Instance, info.Class = class.Instance, class.Class
+		}
+		if pid, err := ewmh.WmPidGet(xu, w); err == nil {
+			info.PID = int(pid)
+		}
+		wins = append(wins, info)
+	}
+	return wins, nil
+}
+
+func printScreenInfo(w io.Writer, info *ScreenInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if !info.Composite {
+		fmt.Fprintln(w, "The COMPOSITE extension isn't available, windows can't be captured.")
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(tw, "ID\tGEOMETRY\tDEPTH\tVISUAL\tPID\tCLASS\tTITLE")
+	for _, win := range info.Windows {
+		pid := "-"
+		if win.PID != 0 {
+			pid = fmt.Sprint(win.PID)
+		}
+		fmt.Fprintf(tw, "0x%x\t%dx%d%+d%+d\t%d\t0x%x\t%s\t%s\t%s\n",
+			win.ID, win.Width, win.Height, win.X, win.Y, win.Depth, win.Visual,
+			pid, win.Class, win.Title)
+	}
+	tw.Flush()
+	if len(info.Monitors) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "MONITOR\tGEOMETRY")
+	for _, mon := range info.Monitors {
+		fmt.Fprintf(tw, "%s\t%dx%d%+d%+d\n", mon.Name, mon.Width, mon.Height, mon.X, mon.Y)
+	}
+	tw.Flush()
+}
+
+func listMain(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the list as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: xcapture list [-json]")
+		fmt.Fprintln(os.Stderr, "Lists the windows and monitors that can be captured.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	xu, err := xgbutil.NewConn()
+	if err != nil {
+		log.Fatal("Couldn't connect to X server:", err)
+	}
+	defer xu.Conn().Close()
+	info := &ScreenInfo{
+		Monitors:  []Monitor{},
+		Composite: composite.Init(xu.Conn()) == nil,
+	}
+	info.Windows, err = listWindows(xu)
+	if err != nil {
+		log.Fatal("Couldn't list windows:", err)
+	}
+	if err := randr.Init(xu.Conn()); err == nil {
+		mons, err := Monitors(xu.Conn(), xu.RootWin())
+		if err != nil {
+			log.Fatal("Couldn't list monitors:", err)
+		}
+		info.Monitors = append(info.Monitors, mons...)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	printScreenInfo(os.Stdout, info)
+}
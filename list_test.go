@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintScreenInfo(t *testing.T) {
+	info := &ScreenInfo{
+		Windows: []WindowInfo{
+			{ID: 0x3a00004, Title: "Terminal", Class: "XTerm", PID: 1234, X: 10, Y: -5, Width: 800, Height: 600, Depth: 24, Visual: 0x21},
+			{ID: 0x400001, Title: "clock", Width: 100, Height: 20, Depth: 32, Visual: 0x5e},
+		},
+		Monitors:  []Monitor{{Name: "DP-1", Width: 2560, Height: 1440}},
+		Composite: true,
+	}
+	var buf bytes.Buffer
+	printScreenInfo(&buf, info)
+	want := `ID         GEOMETRY      DEPTH  VISUAL  PID   CLASS  TITLE
+0x3a00004  800x600+10-5  24     0x21    1234  XTerm  Terminal
+0x400001   100x20+0+0    32     0x5e    -            clock
+
+MONITOR  GEOMETRY
+DP-1     2560x1440+0+0
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/randr"
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// A Monitor is a RandR output that is currently displaying part of
+// the root window.
+type Monitor struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Monitors returns all active monitors. The RANDR extension has to
+// be initialized.
+func Monitors(conn *xgb.Conn, root xproto.Window) ([]Monitor, error) {
+	res, err := randr.GetScreenResourcesCurrent(conn, root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	var mons []Monitor
+	for _, output := range res.Outputs {
+		info, err := randr.GetOutputInfo(conn, output, res.ConfigTimestamp).Reply()
+		if err != nil {
+			return nil, err
+		}
+		if info.Connection != randr.ConnectionConnected || info.Crtc == 0 {
+			continue
+		}
+		crtc, err := randr.GetCrtcInfo(conn, info.Crtc, res.ConfigTimestamp).Reply()
+		if err != nil {
+			return nil, err
+		}
+		mons = append(mons, Monitor{
+			Name:   string(info.Name),
+			X:      int(crtc.X),
+			Y:      int(crtc.Y),
+			Width:  int(crtc.Width),
+			Height: int(crtc.Height),
+		})
+	}
+	return mons, nil
+}
+
+func findMonitor(conn *xgb.Conn, root xproto.Window, name string) (Monitor, error) {
+	mons, err := Monitors(conn, root)
+	if err != nil {
+		return Monitor{}, err
+	}
+	for _, mon := range mons {
+		if mon.Name == name {
+			return mon, nil
+		}
+	}
+	return Monitor{}, fmt.Errorf("no active monitor named %q", name)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+)
+
+// A FramePool hands out the pages of a Buffer to capture frames into.
+// Pages are reference counted: everyone who holds on to a frame keeps
+// a reference to its page, and the page returns to the pool once the
+// last reference has been released.
+type FramePool struct {
+	// Drop makes Get fail instead of waiting when all pages are in
+	// use.
+	Drop bool
+
+	mu    sync.Mutex
+	cond  sync.Cond
+	pages []*Page
+	free  []*Page
+	drops uint64
+}
+
+// A Page is a page of a FramePool's buffer.
+type Page struct {
+	Index int
+	Data  []byte
+
+	pool *FramePool
+	// refs is protected by pool.mu.
+	refs int
+}
+
+func NewFramePool(buf Buffer) *FramePool {
+	p := &FramePool{}
+	p.cond.L = &p.mu
+	for i := 0; i < buf.Pages; i++ {
+		pg := &Page{Index: i, Data: buf.Page(i), pool: p}
+		p.pages = append(p.pages, pg)
+		p.free = append(p.free, pg)
+	}
+	return p
+}
+
+// Get returns a free page, with a reference count of one. If all pages
+// are in use, it waits for one to be released, or, if Drop is set,
+// returns nil and counts the drop.
+func (p *FramePool) Get() *Page {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.free) == 0 {
+		if p.Drop {
+			p.drops++
+			return nil
+		}
+		p.cond.Wait()
+	}
+	// Reuse the page that was released last, whose memory is most
+	// likely still in the CPU's caches.
+	pg := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	pg.refs = 1
+	return pg
+}
+
+// Drops returns the number of times Get failed because no page was
+// free.
+func (p *FramePool) Drops() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.drops
+}
+
+// InUse returns the number of pages that are currently referenced.
+func (p *FramePool) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pages) - len(p.free)
+}
+
+// Retain adds a reference to the page. It does nothing if pg is nil,
+// which is the case for frames that don't come from a pool.
+func (pg *Page) Retain() {
+	if pg == nil {
+		return
+	}
+	pg.pool.mu.Lock()
+	defer pg.pool.mu.Unlock()
+	if pg.refs < 1 {
+		panic("retaining page that isn't in use")
+	}
+	pg.refs++
+}
+
+// Release drops a reference to the page, returning it to the pool
+// when it was the last one. It does nothing if pg is nil.
+func (pg *Page) Release() {
+	if pg == nil {
+		return
+	}
+	p := pg.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pg.refs < 1 {
+		panic("releasing page that isn't in use")
+	}
+	pg.refs--
+	if pg.refs == 0 {
+		p.free = append(p.free, pg)
+		p.cond.Signal()
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska"
+)
+
+func TestFramePoolDrop(t *testing.T) {
+	buf, err := NewMemoryBuffer(16, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buf.Close()
+	pool := NewFramePool(buf)
+	pool.Drop = true
+	var pages []*Page
+	for i := 0; i < 3; i++ {
+		pages = append(pages, pool.Get())
+	}
+	if pg := pool.Get(); pg != nil || pool.Drops() != 1 {
+		t.Fatalf("got page %v and %d drops from an exhausted pool, want nil and 1", pg, pool.Drops())
+	}
+	pages[1].Retain()
+	pages[1].Release()
+	if pool.InUse() != 3 {
+		t.Fatalf("%d pages in use, want 3", pool.InUse())
+	}
+	pages[1].Release()
+	if pg := pool.Get(); pg != pages[1] {
+		t.Fatalf("got page %v, want the released page", pg)
+	}
+}
+
+// TestFramePool feeds a VideoWriter from a synthetic source that
+// captures into a small pool as fast as it can. It is meant to be run
+// with the race detector.
+func TestFramePool(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		canvas := Canvas{Width: 2, Height: 2}
+		buf, err := NewMemoryBuffer(canvas.Width*canvas.Height*bytesPerPixel, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer buf.Close()
+		pool := NewFramePool(buf)
+
+		var out bytes.Buffer
+		vw := NewVideoWriter(canvas, 100, true, nil, &out)
+		vw.Compress = compress
+		vw.Workers = 2
+		if err := vw.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Frames are numbered by the value of their bytes.
+		const n = 255
+		ch := make(chan Frame)
+		start := time.Now()
+		go func() {
+			for i := 1; i <= n; i++ {
+				page := pool.Get()
+				for j := range page.Data {
+					page.Data[j] = byte(i)
+				}
+				ch <- Frame{Data: page.Data, Time: start.Add(time.Duration(i) * 10 * time.Millisecond), Page: page}
+			}
+			close(ch)
+		}()
+		snapshots := make(chan struct{})
+		go func() {
+			defer close(snapshots)
+			for i := 0; i < 50; i++ {
+				vw.Snapshot()
+			}
+		}()
+		for frame := range ch {
+			ts := frame.Time
+			if err := vw.SendFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+			// Repeat the frame now and then, as the writer does
+			// when capturing falls behind.
+			if ts.Sub(start)%(70*time.Millisecond) == 0 {
+				if err := vw.SendFrame(Frame{Time: ts.Add(5 * time.Millisecond)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		<-snapshots
+		if err := vw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if pool.InUse() != 0 {
+			t.Errorf("%d pages still in use after closing the writer", pool.InUse())
+		}
+
+		mr, err := matroska.NewReader(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev := byte(0)
+		frames := 0
+		for {
+			p, err := mr.ReadPacket()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := p.Data[0]
+			if !bytes.Equal(p.Data, bytes.Repeat([]byte{v}, len(p.Data))) || v < prev {
+				t.Fatalf("compress=%t: frame %d was overwritten: %v", compress, frames, p.Data)
+			}
+			prev = v
+			frames++
+		}
+		if frames < n || prev != byte(n) {
+			t.Errorf("compress=%t: got %d frames ending in %d, want at least %d ending in %d", compress, frames, prev, n, byte(n))
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/composite"
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/ewmh"
+	"github.com/BurntSushi/xgbutil/icccm"
+)
+
+// PopupTracker keeps track of menus, tooltips, dialogs and other
+// windows that belong to the captured window but are separate
+// top-level windows, so that they can be drawn on top of it.
+//
+// A window is tracked if it is override-redirect or transient, and if
+// it is transient for the captured window, belongs to the same
+// process, or overlaps the captured window.
+type PopupTracker struct {
+	C      chan CaptureEvent
+	elCh   chan xgb.Event
+	xu     *xgbutil.XUtil
+	win    *Window
+	damage bool
+	pid    uint
+
+	mu      sync.Mutex
+	tracked map[xproto.Window]*popup
+	// popups are the tracked windows that are stacked above the
+	// captured window, from bottom to top.
+	popups []xproto.Window
+	// winX and winY are the position of the captured window relative
+	// to the root window.
+	winX, winY int
+}
+
+// A popup is a tracked window. Its geometry is kept up to date from
+// ConfigureNotify events, and its image is fetched again only once
+// it has been damaged, so that drawing popups usually doesn't need
+// to talk to the X server.
+type popup struct {
+	damage damage.Damage
+	// The position of the popup's contents relative to the root
+	// window, and their size.
+	x, y          int
+	width, height int
+	// stale is set if image doesn't reflect the popup's contents.
+	stale bool
+
+	// image and alpha are only used by Draw, which fetches the image
+	// without holding the PopupTracker's mutex.
+	image []byte
+	alpha bool
+}
+
+// NewPopupTracker starts tracking popups of win. If useDamage is
+// true, it creates damage objects for all popups, so that their
+// updates show up in the DamageMonitor, and so that we know when to
+// fetch their contents again. Otherwise, their contents are fetched
+// for every frame. The DAMAGE extension has to be initialized.
+func NewPopupTracker(xu *xgbutil.XUtil, el *EventLoop, win *Window, useDamage bool) (*PopupTracker, error) {
+	pt := &PopupTracker{
+		C:       make(chan CaptureEvent, 1),
+		elCh:    make(chan xgb.Event),
+		xu:      xu,
+		win:     win,
+		damage:  useDamage,
+		tracked: map[xproto.Window]*popup{},
+	}
+	// Not every client sets _NET_WM_PID, in which case we only go by
+	// transience and overlap.
+	pt.pid, _ = ewmh.WmPidGet(xu, clientWindow(xu, xproto.Window(win.ID)))
+
+	// Select events before looking at the existing windows, so that
+	// we can't miss any.
+	err := xproto.ChangeWindowAttributesChecked(xu.Conn(), xu.RootWin(),
+		xproto.CwEventMask, []uint32{uint32(xproto.EventMaskSubstructureNotify)}).Check()
+	if err != nil {
+		return nil, err
+	}
+	el.Register(pt.elCh)
+
+	tree, err := xproto.QueryTree(xu.Conn(), xu.RootWin()).Reply()
+	if err != nil {
+		return nil, err
+	}
+	pt.mu.Lock()
+	for _, child := range tree.Children {
+		attrs, err := xproto.GetWindowAttributes(xu.Conn(), child).Reply()
+		if err != nil || attrs.MapState != xproto.MapStateViewable {
+			continue
+		}
+		if pt.belongs(child) {
+			pt.track(child)
+		}
+	}
+	pt.restack()
+	pt.mu.Unlock()
+
+	go pt.start()
+	return pt, nil
+}
+
+func (pt *PopupTracker) start() {
+	root := pt.xu.RootWin()
+	for ev := range pt.elCh {
+		// changed is set if the set or order of popups changed,
+		// damaged if only the contents of one did.
+		changed, damaged := false, false
+		pt.mu.Lock()
+		switch ev := ev.(type) {
+		case xproto.MapNotifyEvent:
+			if ev.Event == root && pt.belongs(ev.Window) {
+				pt.track(ev.Window)
+				changed = true
+			}
+		case xproto.UnmapNotifyEvent:
+			if _, ok := pt.tracked[ev.Window]; ok && ev.Event == root {
+				pt.untrack(ev.Window, true)
+				changed = true
+			}
+		case xproto.DestroyNotifyEvent:
+			if _, ok := pt.tracked[ev.Window]; ok && ev.Event == root {
+				pt.untrack(ev.Window, false)
+				changed = true
+			}
+		case xproto.ConfigureNotifyEvent:
+			if p, ok := pt.tracked[ev.Window]; ok && ev.Event == root {
+				bw := int(ev.BorderWidth)
+				p.x, p.y = int(ev.X)+bw, int(ev.Y)+bw
+				if int(ev.Width) != p.width || int(ev.Height) != p.height {
+					p.width, p.height = int(ev.Width), int(ev.Height)
+					p.stale = true
+				}
+			}
+			// Any top-level window, including the captured window's
+			// frame, may have been moved or restacked.
+			changed = ev.Event == root && len(pt.tracked) > 0
+		case damage.NotifyEvent:
+			if p, ok := pt.tracked[xproto.Window(ev.Drawable)]; ok {
+				p.stale = true
+				damaged = true
+			}
+		}
+		if changed {
+			pt.restack()
+		}
+		pt.mu.Unlock()
+
+		// The DamageMonitor may have triggered a capture already,
+		// which would draw the old image of a damaged popup.
+		if changed || damaged {
+			select {
+			case pt.C <- CaptureEvent{}:
+			default:
+			}
+		}
+	}
+}
+
+// belongs reports whether the top-level window w is a popup of the
+// captured window.
+func (pt *PopupTracker) belongs(w xproto.Window) bool {
+	target := xproto.Window(pt.win.ID)
+	attrs, err := xproto.GetWindowAttributes(pt.xu.Conn(), w).Reply()
+	if err != nil || attrs.Class == xproto.WindowClassInputOnly {
+		return false
+	}
+	client := w
+	if !attrs.OverrideRedirect {
+		client = clientWindow(pt.xu, w)
+	}
+	if client == target {
+		return false
+	}
+	transientFor, err := icccm.WmTransientForGet(pt.xu, client)
+	transient := err == nil
+	if !attrs.OverrideRedirect && !transient {
+		return false
+	}
+	if transient && transientFor == target {
+		return true
+	}
+	if pt.pid != 0 {
+		if pid, err := ewmh.WmPidGet(pt.xu, client); err == nil && pid == pt.pid {
+			return true
+		}
+	}
+	return pt.overlaps(w)
+}
+
+// overlaps reports whether the top-level window w overlaps the
+// captured window.
+func (pt *PopupTracker) overlaps(w xproto.Window) bool {
+	geom, err := xproto.GetGeometry(pt.xu.Conn(), xproto.Drawable(w)).Reply()
+	if err != nil {
+		return false
+	}
+	pos, err := xproto.TranslateCoordinates(pt.xu.Conn(), xproto.Window(pt.win.ID), pt.xu.RootWin(), 0, 0).Reply()
+	if err != nil {
+		return false
+	}
+	width, height, _ := pt.win.Dimensions()
+	x, y := int(pos.DstX), int(pos.DstY)
+	return int(geom.X) < x+width && int(geom.X)+int(geom.Width) > x &&
+		int(geom.Y) < y+height && int(geom.Y)+int(geom.Height) > y
+}
+
+func (pt *PopupTracker) track(w xproto.Window) {
+	geom, err := xproto.GetGeometry(pt.xu.Conn(), xproto.Drawable(w)).Reply()
+	if err != nil {
+		return
+	}
+	// Redirect the popup, so that we can read its contents even if
+	// it is obscured.
+	composite.RedirectWindow(pt.xu.Conn(), w, composite.RedirectAutomatic)
+	bw := int(geom.BorderWidth)
+	p := &popup{
+		x:      int(geom.X) + bw,
+		y:      int(geom.Y) + bw,
+		width:  int(geom.Width),
+		height: int(geom.Height),
+		stale:  true,
+	}
+	if pt.damage {
+		xdmg, err := damage.NewDamageId(pt.xu.Conn())
+		if err != nil {
+			log.Println("Couldn't monitor popup for damage:", err)
+		} else {
+			damage.Create(pt.xu.Conn(), xdmg, xproto.Drawable(w), damage.ReportLevelRawRectangles)
+			p.damage = xdmg
+		}
+	}
+	pt.tracked[w] = p
+}
+
+func (pt *PopupTracker) untrack(w xproto.Window, alive bool) {
+	if alive {
+		if xdmg := pt.tracked[w].damage; xdmg != 0 {
+			damage.Destroy(pt.xu.Conn(), xdmg)
+		}
+		composite.UnredirectWindow(pt.xu.Conn(), w, composite.RedirectAutomatic)
+	}
+	delete(pt.tracked, w)
+}
+
+// restack updates the list of popups to draw, in stacking order.
+func (pt *PopupTracker) restack() {
+	pt.popups = pt.popups[:0]
+	if len(pt.tracked) == 0 {
+		return
+	}
+	frame, err := topLevel(pt.xu, xproto.Window(pt.win.ID))
+	if err != nil {
+		return
+	}
+	tree, err := xproto.QueryTree(pt.xu.Conn(), pt.xu.RootWin()).Reply()
+	if err != nil {
+		return
+	}
+	pos, err := xproto.TranslateCoordinates(pt.xu.Conn(), xproto.Window(pt.win.ID), pt.xu.RootWin(), 0, 0).Reply()
+	if err != nil {
+		return
+	}
+	pt.winX, pt.winY = int(pos.DstX), int(pos.DstY)
+	above := false
+	for _, child := range tree.Children {
+		if child == frame {
+			above = true
+			continue
+		}
+		if _, ok := pt.tracked[child]; ok && above {
+			pt.popups = append(pt.popups, child)
+		}
+	}
+}
+
+// Draw draws all popups onto page, at their position relative to the
+// captured window. Only the images of popups that changed since the
+// last call are fetched from the X server.
+func (pt *PopupTracker) Draw(page []byte, canvas Canvas) {
+	type draw struct {
+		w                   xproto.Window
+		p                   *popup
+		x, y, width, height int
+		fetch               bool
+	}
+	// Fetching images takes round trips, during which we mustn't
+	// hold up the handling of events, so work on a snapshot of the
+	// popups.
+	pt.mu.Lock()
+	draws := make([]draw, len(pt.popups))
+	for i, w := range pt.popups {
+		p := pt.tracked[w]
+		draws[i] = draw{w, p, p.x - pt.winX, p.y - pt.winY, p.width, p.height, p.stale || !pt.damage}
+		p.stale = false
+	}
+	pt.mu.Unlock()
+
+	conn := pt.xu.Conn()
+	maxStrip := int(xproto.Setup(conn).MaximumRequestLength) * 4
+	for _, d := range draws {
+		p := d.p
+		if d.fetch {
+			if n := d.width * d.height * bytesPerPixel; len(p.image) < n {
+				p.image = make([]byte, n)
+			}
+			depth, err := getImage(conn, xproto.Drawable(d.w), 0, 0, d.width, d.height, maxStrip, p.image)
+			if err != nil {
+				pt.mu.Lock()
+				p.stale = true
+				pt.mu.Unlock()
+				continue
+			}
+			p.alpha = depth == 32
+		}
+		blit(page, canvas, p.image, d.width, d.height, d.x, d.y, p.alpha)
+	}
+}
+
+// Close stops redirecting the popups.
+func (pt *PopupTracker) Close() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for w := range pt.tracked {
+		pt.untrack(w, true)
+	}
+	pt.popups = nil
+}
+
+// blit draws the w×h image src at x, y onto the canvas dst. If alpha
+// is true, src has a premultiplied alpha channel and gets blended
+// onto dst. Otherwise, it is opaque.
+func blit(dst []byte, canvas Canvas, src []byte, w, h, x, y int, alpha bool) {
+	x0, x1 := x, x+w
+	if x0 < 0 {
+		x0 = 0
+	}
+	if x1 > canvas.Width {
+		x1 = canvas.Width
+	}
+	if x0 >= x1 {
+		return
+	}
+	for row := 0; row < h; row++ {
+		dy := y + row
+		if dy < 0 || dy >= canvas.Height {
+			continue
+		}
+		s := src[(row*w+x0-x)*bytesPerPixel : (row*w+x1-x)*bytesPerPixel]
+		d := dst[(dy*canvas.Width+x0)*bytesPerPixel : (dy*canvas.Width+x1)*bytesPerPixel]
+		if !alpha {
+			copy(d, s)
+			continue
+		}
+		for i := 0; i < len(s); i += bytesPerPixel {
+			inv := 255 - uint32(s[i+3])
+			d[i+0] = s[i+0] + byte(uint32(d[i+0])*inv/255)
+			d[i+1] = s[i+1] + byte(uint32(d[i+1])*inv/255)
+			d[i+2] = s[i+2] + byte(uint32(d[i+2])*inv/255)
+			d[i+3] = 255
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska"
+)
+
+// remux copies the recording in r to w, keeping everything up to the
+// first error. Frames are copied as they are, without being
+// decompressed. It reports how many frames it copied and whether the
+// input was cut short.
+func remux(w io.Writer, r io.Reader) (frames int, truncated bool, err error) {
+	mr, err := matroska.NewReader(r)
+	if err != nil {
+		return 0, false, err
+	}
+	mr.Raw = true
+
+	out := mr.Segment
+	// Let the muxer calculate the duration of what we actually copy.
+	out.Duration = 0
+	defaults := map[int]time.Duration{}
+	for _, t := range out.Tracks {
+		defaults[t.Number] = t.DefaultDuration
+	}
+	if err := out.Write(w); err != nil {
+		return 0, false, err
+	}
+	for {
+		p, err := mr.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			truncated = true
+			break
+		}
+		if p.Duration == defaults[p.Track] {
+			p.Duration = 0
+		}
+		if err := out.WriteFrame(p.Frame); err != nil {
+			return frames, truncated, err
+		}
+		frames++
+	}
+	for _, ch := range mr.Chapters {
+		out.AddChapter(ch)
+	}
+	return frames, truncated, out.Close()
+}
+
+func repairMain(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: xcapture repair in.mkv [out.mkv]")
+		fmt.Fprintln(os.Stderr, "Repairs the input in place if no output file is given.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch fs.NArg() {
+	case 1:
+		f, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		res, err := matroska.Repair(f)
+		if err == matroska.ErrNotRepairable {
+			log.Fatal("Couldn't repair the file in place, specify an output file instead")
+		}
+		if err != nil {
+			log.Fatal("Couldn't repair recording:", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal("Couldn't repair recording:", err)
+		}
+		if res.Intact {
+			fmt.Printf("The recording is intact, %d frames\n", res.Frames)
+			return
+		}
+		fmt.Printf("Kept %d frames (%s), dropped %d bytes\n", res.Frames, res.Duration, res.Dropped)
+	case 2:
+		in, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+		if fi, err := os.Stat(fs.Arg(1)); err == nil {
+			if ini, err := in.Stat(); err == nil && os.SameFile(fi, ini) {
+				log.Fatal("Refusing to overwrite the input, leave out the output file to repair in place")
+			}
+		}
+		out, err := os.Create(fs.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		frames, truncated, err := remux(out, bufio.NewReader(in))
+		if err != nil {
+			log.Fatal("Couldn't repair recording:", err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatal("Couldn't write repaired recording:", err)
+		}
+		if truncated {
+			fmt.Printf("Copied %d frames, dropped the incomplete rest\n", frames)
+		} else {
+			fmt.Printf("Copied %d frames\n", frames)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska"
+)
+
+func TestRepair(t *testing.T) {
+	f, err := ioutil.TempFile("", "xcapture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Send four frames, but never close the writer, as if we had
+	// crashed. Only three of them get written, as the last one's
+	// duration isn't known yet.
+	canvas := Canvas{Width: 2, Height: 2}
+	vw := NewVideoWriter(canvas, 10, false, nil, f)
+	if err := vw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		err := vw.SendFrame(Frame{Data: bytes.Repeat([]byte{byte(i)}, 16), Time: start.Add(time.Duration(i) * 100 * time.Millisecond)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the file in the middle of the third cluster
+	cluster := []byte{0x1F, 0x43, 0xB6, 0x75}
+	cut := int64(bytes.LastIndex(data, cluster) + 10)
+	if err := f.Truncate(cut); err != nil {
+		t.Fatal(err)
+	}
+
+	var remuxed bytes.Buffer
+	frames, truncated, err := remux(&remuxed, bytes.NewReader(data[:cut]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != 2 || !truncated {
+		t.Errorf("remux copied %d frames with truncated=%t, want 2 frames of a truncated file", frames, truncated)
+	}
+
+	res, err := matroska.Repair(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Frames != 2 || res.Duration != 200*time.Millisecond || res.Intact {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	info, err := inspect(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != 2 || !info.Cues || !info.Finalized || info.Truncated {
+		t.Errorf("unexpected summary of repaired file %+v", info)
+	}
+
+	res, err = matroska.Repair(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Intact {
+		t.Errorf("repaired file wasn't intact: %+v", res)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ring holds the most recent blocks, covering at least length worth
+// of time. It is used for instant replays.
+type ring struct {
+	length time.Duration
+
+	mu     sync.Mutex
+	blocks []*replayBlock
+	// free holds buffers of evicted blocks for reuse, so that we
+	// don't allocate a new frame's worth of memory for every frame.
+	free [][]byte
+	// readers is the number of dumps in progress. Evicted blocks may
+	// still be in use by them and must not be reused.
+	readers int
+}
+
+type replayBlock struct {
+	tc   uint64
+	dur  uint64
+	data []byte
+}
+
+// maxFree is the number of evicted buffers we keep around for reuse.
+const maxFree = 4
+
+func newRing(length time.Duration) *ring {
+	return &ring{length: length}
+}
+
+// add stores a copy of block.
+func (r *ring) add(tc, dur uint64, block []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var buf []byte
+	if n := len(r.free); n > 0 {
+		buf = r.free[n-1][:0]
+		r.free[n-1] = nil
+		r.free = r.free[:n-1]
+	}
+	buf = append(buf, block...)
+	r.blocks = append(r.blocks, &replayBlock{tc, dur, buf})
+
+	// Evict the oldest block as long as the remaining ones still
+	// cover the desired length.
+	end := tc + dur
+	for len(r.blocks) > 1 && end-r.blocks[1].tc >= uint64(r.length) {
+		old := r.blocks[0]
+		r.blocks[0] = nil
+		r.blocks = r.blocks[1:]
+		if r.readers == 0 && len(r.free) < maxFree {
+			r.free = append(r.free, old.data)
+		}
+	}
+}
+
+// acquire returns the blocks currently held, oldest first. The
+// blocks remain valid until release is called.
+func (r *ring) acquire() []*replayBlock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readers++
+	return append([]*replayBlock(nil), r.blocks...)
+}
+
+func (r *ring) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readers--
+}
+
+var dumpMu sync.Mutex
+
+// dumpReplay writes the current replay buffer of vw to a new file in
+// dir and returns the file's name.
+func dumpReplay(vw *VideoWriter, dir string) (string, error) {
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	name := filepath.Join(dir, "xcapture-replay-"+time.Now().Format("20060102-150405.000")+".mkv")
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	if err := vw.Dump(f); err != nil {
+		f.Close()
+		return name, err
+	}
+	return name, f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// Stats is a snapshot of the statistics shown by the status output.
+// Latencies are in milliseconds.
+type Stats struct {
+	Frames       int64        `json:"frames"`
+	Dupped       int          `json:"dupped"`
+	Dropped      uint64       `json:"dropped"`
+	Recording    float64      `json:"recording_seconds"`
+	Slowdowns    uint64       `json:"slowdowns"`
+	LastSlowdown *time.Time   `json:"last_slowdown,omitempty"`
+	Capture      LatencyStats `json:"capture"`
+	Write        LatencyStats `json:"write"`
+	Render       LatencyStats `json:"render"`
+}
+
+type LatencyStats struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	P999   float64 `json:"p99.9"`
+}
+
+func latencyStats(h *hdrhistogram.Histogram) LatencyStats {
+	return LatencyStats{
+		Min:    milliseconds(h.Min()),
+		Max:    milliseconds(h.Max()),
+		Mean:   milliseconds(int64(h.Mean())),
+		StdDev: milliseconds(int64(h.StdDev())),
+		P50:    milliseconds(h.ValueAtQuantile(50)),
+		P90:    milliseconds(h.ValueAtQuantile(90)),
+		P99:    milliseconds(h.ValueAtQuantile(99)),
+		P999:   milliseconds(h.ValueAtQuantile(99.9)),
+	}
+}
@@ -2,32 +2,104 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"image"
 	"io"
+	"math"
+	"sync"
 	"time"
 
 	"honnef.co/go/xcapture/internal/matroska"
-	"honnef.co/go/xcapture/internal/matroska/ebml"
 )
 
 type VideoWriter struct {
-	enc       *ebml.Encoder
+	// Compress enables zlib compression of frames, using Workers
+	// goroutines. Both have to be set before calling Start.
+	Compress bool
+	Workers  int
+	// Replay, if non-zero, makes the writer keep the last Replay
+	// worth of frames in memory instead of writing them out. Dump
+	// writes them to a new stream. It has to be set before calling
+	// Start.
+	Replay time.Duration
+	// Split, if not nil, makes the writer split the recording into
+	// several files, linked to each other as parts of a segment
+	// family. It is called to create the file for each part, counting
+	// from 1. A new part starts at the first cluster that would make
+	// the current part larger than SplitSize bytes, or longer than
+	// SplitDuration. If SplitRebase is set, the timestamps of each
+	// part start at 0, otherwise they continue where the previous
+	// part ended. All have to be set before calling Start.
+	//
+	// Splitting is also needed for frames of different sizes: a
+	// frame whose Canvas differs from the previous one starts a new
+	// part, with the new size.
+	Split         func(part int) (io.WriteCloser, error)
+	SplitSize     int
+	SplitDuration time.Duration
+	SplitRebase   bool
+	// Splice makes the writer pass frames to the output by
+	// reference if it is a pipe. Lend is called with each frame's
+	// data before it is written, with an until of math.MaxInt, and
+	// afterwards with the position up to which the output has to be
+	// consumed before the data may be modified again; see Consumed.
+	// Splicing can't be combined with compression, replays or
+	// splitting. Consumed relies on the reader reading from the
+	// pipe; a reader that splices out of it leaves the data
+	// referenced after it is no longer counted as unread.
+	Splice bool
+	Lend   func(data []byte, until int)
+
+	w   io.Writer
+	out *matroska.MKV
+	// from is the timestamp, in the timeline of the whole
+	// recording, at which out starts. base is subtracted from all
+	// timestamps written to out.
+	from, base uint64
+	part       int
+	partFile   io.WriteCloser
+	family     [16]byte
+
+	// chMu protects chapters. It is separate from mu because
+	// chapters are also needed by store, which may run on the
+	// compressor's goroutine.
+	chMu     sync.Mutex
+	chapters []chapter
+
+	// mu protects the fields below, which may be accessed by
+	// Pause, Resume, AddChapter and Snapshot while we're writing
+	// frames.
+	mu        sync.Mutex
 	firstTime time.Time // XXX rename
 	prevFrame Frame
-	block     []byte
 	canvas    Canvas
 	fps       int
 	cfr       bool
 	tags      map[string]string
 
-	idx int
+	idx        int
+	compressor *compressor
+	ring       *ring
+
+	// pausedAt is the time at which recording was paused, or the zero
+	// time. gap is the total duration of all pauses so far, which we
+	// subtract from frame timestamps.
+	pausedAt time.Time
+	gap      time.Duration
 }
 
+type chapter struct {
+	time  uint64
+	title string
+}
+
+// NewVideoWriter returns a writer that writes a Matroska stream to w.
+// In replay mode, w is not used and may be nil.
 func NewVideoWriter(c Canvas, fps int, cfr bool, tags map[string]string, w io.Writer) *VideoWriter {
-	const hdrSize = 4
 	return &VideoWriter{
-		enc:    ebml.NewEncoder(w),
-		block:  make([]byte, c.Width*c.Height*bytesPerPixel+hdrSize),
+		w:      w,
 		canvas: c,
 		fps:    fps,
 		cfr:    cfr,
@@ -35,9 +107,77 @@ func NewVideoWriter(c Canvas, fps int, cfr bool, tags map[string]string, w io.Wr
 	}
 }
 
+// newUID returns a random UID for a segment.
+func newUID() [16]byte {
+	var uid [16]byte
+	if _, err := rand.Read(uid[:]); err != nil {
+		panic(err)
+	}
+	return uid
+}
+
 func (vw *VideoWriter) Start() error {
-	vw.block[0] = 129
+	if vw.Replay > 0 {
+		vw.ring = newRing(vw.Replay)
+	} else if vw.Split != nil {
+		// The first part gets started by the first frame, which
+		// determines its size.
+		vw.family = newUID()
+	} else {
+		var err error
+		vw.out, err = vw.newOutput(vw.w, &matroska.MKV{SegmentUID: newUID()})
+		if err != nil {
+			return err
+		}
+	}
+	if vw.Compress {
+		vw.compressor = newCompressor(vw.Workers, vw.store)
+	}
+	return nil
+}
+
+// startPart finishes the current part, if any, and starts the next
+// one at timestamp tc.
+func (vw *VideoWriter) startPart(tc uint64) error {
+	info := &matroska.MKV{
+		SegmentUID:    newUID(),
+		NextUID:       newUID(),
+		SegmentFamily: [][16]byte{vw.family},
+	}
+	if vw.out != nil {
+		// The current part already refers to our UID.
+		info.SegmentUID = vw.out.NextUID
+		info.PrevUID = vw.out.SegmentUID
+		vw.addChapters(vw.out, vw.from, tc, vw.base)
+		if err := vw.out.Close(); err != nil {
+			return err
+		}
+		if err := vw.partFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	vw.part++
+	f, err := vw.Split(vw.part)
+	if err != nil {
+		return err
+	}
+	out, err := vw.newOutput(f, info)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	vw.out = out
+	vw.partFile = f
+	vw.from = tc
+	if vw.SplitRebase {
+		vw.base = tc
+	}
+	return nil
+}
 
+// newOutput starts a new stream on w, described by info.
+func (vw *VideoWriter) newOutput(w io.Writer, info *matroska.MKV) (*matroska.MKV, error) {
 	bmp := BitmapInfoHeader{
 		Width:    int32(vw.canvas.Width),
 		Height:   int32(-vw.canvas.Height),
@@ -48,54 +188,59 @@ func (vw *VideoWriter) Start() error {
 	if err := binary.Write(codec, binary.LittleEndian, bmp); err != nil {
 		panic(err)
 	}
+	track := matroska.Track{
+		Number:          1,
+		UID:             0xDEADBEEF,
+		Type:            matroska.VideoTrack,
+		CodecID:         "V_MS/VFW/FOURCC",
+		CodecPrivate:    codec.Bytes(),
+		DefaultDuration: time.Second / time.Duration(vw.fps),
+		Video: &matroska.VideoSettings{
+			PixelWidth:     vw.canvas.Width,
+			PixelHeight:    vw.canvas.Height,
+			ColourSpace:    []byte("BGRA"),
+			BitsPerChannel: 8,
+		},
+	}
+	if vw.Compress {
+		track.Compression = matroska.Zlib
+	}
 
-	vw.enc.Emit(
-		ebml.EBML(
-			ebml.DocType(ebml.String("matroska")),
-			ebml.DocTypeVersion(ebml.Uint(4)),
-			ebml.DocTypeReadVersion(ebml.Uint(1))))
-
-	vw.enc.EmitHeader(matroska.Segment, -1)
-	vw.enc.Emit(
-		matroska.Info(
-			matroska.TimecodeScale(ebml.Uint(1)),
-			matroska.MuxingApp(ebml.UTF8("honnef.co/go/mkv")),
-			matroska.WritingApp(ebml.UTF8("xcapture"))))
-
-	var tags []ebml.Object
-	for k, v := range vw.tags {
-		tag := matroska.Tag(
-			matroska.SimpleTag(
-				matroska.TagName(ebml.UTF8(k)),
-				matroska.TagString(ebml.UTF8(v))))
-		tags = append(tags, tag)
-	}
-	vw.enc.Emit(matroska.Tags(tags...))
-
-	vw.enc.Emit(
-		matroska.Tracks(
-			matroska.TrackEntry(
-				matroska.TrackNumber(ebml.Uint(1)),
-				matroska.TrackUID(ebml.Uint(0xDEADBEEF)),
-				matroska.TrackType(ebml.Uint(1)),
-				matroska.FlagLacing(ebml.Uint(0)),
-				matroska.DefaultDuration(ebml.Uint(time.Second/time.Duration(vw.fps))),
-				matroska.CodecID(ebml.String("V_MS/VFW/FOURCC")),
-				matroska.CodecPrivate(ebml.Binary(codec.Bytes())),
-				matroska.Video(
-					matroska.PixelWidth(ebml.Uint(vw.canvas.Width)),
-					matroska.PixelHeight(ebml.Uint(vw.canvas.Height)),
-					matroska.ColourSpace(ebml.Binary("BGRA")),
-					matroska.Colour(
-						matroska.BitsPerChannel(ebml.Uint(8)))))))
-	return vw.enc.Err
+	info.WritingApp = "xcapture"
+	info.Date = time.Now()
+	info.Tags = vw.tags
+	info.Tracks = []matroska.Track{track}
+	return info, info.Write(w)
 }
 
+// SendFrame adds a frame to the recording. A frame without data
+// repeats the previous one. SendFrame takes over the caller's
+// reference to the frame's page.
 func (vw *VideoWriter) SendFrame(frame Frame) error {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	return vw.sendFrame(frame)
+}
+
+func (vw *VideoWriter) sendFrame(frame Frame) error {
+	if !vw.pausedAt.IsZero() {
+		frame.Page.Release()
+		return nil
+	}
+	frame.Time = frame.Time.Add(-vw.gap)
 	if vw.prevFrame.Data == nil && frame.Data != nil {
 		// This is our first frame
 		vw.prevFrame = frame
 		vw.firstTime = frame.Time
+		if vw.Split != nil && vw.ring == nil {
+			if frame.Canvas != (Canvas{}) {
+				vw.canvas = frame.Canvas
+			}
+			return vw.startPart(0)
+		}
+		if vw.resized(frame) {
+			return vw.resize(frame.Canvas, 0)
+		}
 		return nil
 	}
 	if frame.Data == nil {
@@ -108,13 +253,15 @@ func (vw *VideoWriter) SendFrame(frame Frame) error {
 			return nil
 		}
 		frame.Data = vw.prevFrame.Data
+		frame.Page = vw.prevFrame.Page
+		frame.Canvas = vw.prevFrame.Canvas
+		frame.Page.Retain()
 	}
-	copy(vw.block[4:], vw.prevFrame.Data)
 	ts := vw.prevFrame.Time.Sub(vw.firstTime)
-	var tc, bg ebml.Element
+	var tc, dur uint64
 	if vw.cfr {
-		tc = matroska.Timecode(ebml.Uint(vw.idx * int(time.Second/time.Duration(vw.fps))))
-		bg = matroska.BlockGroup(matroska.Block(ebml.Binary(vw.block)))
+		tc = uint64(vw.idx * int(time.Second/time.Duration(vw.fps)))
+		dur = uint64(time.Second / time.Duration(vw.fps))
 	} else {
 		if vw.prevFrame.Time.After(frame.Time) {
 			// Drop time travelling frames that may occur due to
@@ -125,16 +272,253 @@ func (vw *VideoWriter) SendFrame(frame Frame) error {
 			// Such frames are very unlikely to occur because in VFR
 			// mode, dupped frames are rarely written as actual
 			// frames, only once a second if no other frame occured.
+			frame.Page.Release()
 			return nil
 		}
-		tc = matroska.Timecode(ebml.Uint(ts))
-		bg = matroska.BlockGroup(
-			matroska.BlockDuration(ebml.Uint(frame.Time.Sub(vw.prevFrame.Time))),
-			matroska.Block(ebml.Binary(vw.block)))
+		tc = uint64(ts)
+		dur = uint64(frame.Time.Sub(vw.prevFrame.Time))
 	}
-	vw.enc.Emit(matroska.Cluster(tc, matroska.Position(ebml.Uint(0)), bg))
 
+	var err error
+	if vw.compressor != nil {
+		err = vw.compressor.Submit(tc, dur, vw.prevFrame.Data)
+	} else {
+		err = vw.store(tc, dur, vw.prevFrame.Data)
+	}
+	// Both the compressor and the replay ring copy the frame, so
+	// we're done with it.
+	vw.prevFrame.Page.Release()
 	vw.prevFrame = frame
 	vw.idx++
-	return vw.enc.Err
+	if err == nil && vw.resized(frame) {
+		// The frame we're holding back starts where the previous one
+		// ends.
+		err = vw.resize(frame.Canvas, tc+dur)
+	}
+	return err
+}
+
+func (vw *VideoWriter) resized(frame Frame) bool {
+	return frame.Canvas != (Canvas{}) && frame.Canvas != vw.canvas
+}
+
+// resize starts a new part at timestamp tc, for frames of size c.
+func (vw *VideoWriter) resize(c Canvas, tc uint64) error {
+	if vw.Split == nil || vw.ring != nil {
+		return errors.New("changing the frame size requires splitting")
+	}
+	// All frames of the old size have to be written before we can
+	// start the new part.
+	if vw.compressor != nil {
+		if err := vw.compressor.Close(); err != nil {
+			return err
+		}
+		vw.compressor = newCompressor(vw.Workers, vw.store)
+	}
+	vw.canvas = c
+	return vw.startPart(tc)
+}
+
+// store writes a finished frame to the output, or keeps it in memory
+// in replay mode. With compression enabled, it is called from the
+// compressor's goroutine.
+func (vw *VideoWriter) store(tc, dur uint64, data []byte) error {
+	if vw.ring != nil {
+		vw.ring.add(tc, dur, data)
+		return nil
+	}
+	if vw.Split != nil && vw.out.Frames() > 0 && vw.splitDue(tc, len(data)) {
+		if err := vw.startPart(tc); err != nil {
+			return err
+		}
+	}
+	if vw.Splice && vw.compressor == nil {
+		return vw.spliceFrame(vw.out, tc-vw.base, dur, data)
+	}
+	return vw.writeFrame(vw.out, tc-vw.base, dur, data, false)
+}
+
+func (vw *VideoWriter) writeFrame(out *matroska.MKV, tc, dur uint64, data []byte, spliceable bool) error {
+	f := matroska.Frame{
+		Track:      1,
+		Timecode:   time.Duration(tc),
+		Keyframe:   true,
+		Data:       data,
+		Spliceable: spliceable,
+	}
+	if !vw.cfr {
+		f.Duration = time.Duration(dur)
+	}
+	return out.WriteFrame(f)
+}
+
+func (vw *VideoWriter) spliceFrame(out *matroska.MKV, tc, dur uint64, data []byte) error {
+	vw.Lend(data, math.MaxInt)
+	if err := vw.writeFrame(out, tc, dur, data, true); err != nil {
+		return err
+	}
+	vw.Lend(data, out.Position())
+	return nil
+}
+
+// Consumed returns how far the reader of the output has consumed
+// it. It is meant for use with Splice and may be called concurrently
+// with SendFrame.
+func (vw *VideoWriter) Consumed() (int, error) {
+	return vw.out.Consumed()
+}
+
+// splitDue reports whether a frame of n bytes at timestamp tc has to
+// go into a new part.
+func (vw *VideoWriter) splitDue(tc uint64, n int) bool {
+	if vw.SplitSize > 0 && vw.out.Position()+n > vw.SplitSize {
+		return true
+	}
+	return vw.SplitDuration > 0 && tc-vw.from >= uint64(vw.SplitDuration)
+}
+
+// addChapters adds the chapters in [from, to) to out, with base
+// subtracted from their timestamps.
+func (vw *VideoWriter) addChapters(out *matroska.MKV, from, to, base uint64) {
+	vw.chMu.Lock()
+	defer vw.chMu.Unlock()
+	for _, ch := range vw.chapters {
+		if ch.time >= from && ch.time < to {
+			out.AddChapter(matroska.Chapter{Start: time.Duration(ch.time - base), Title: ch.title})
+		}
+	}
+}
+
+// Pause stops recording at time t. Frames sent while paused are
+// dropped, and the time spent paused will not show up in the
+// recording.
+func (vw *VideoWriter) Pause(t time.Time) {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	if vw.pausedAt.IsZero() {
+		vw.pausedAt = t
+	}
+}
+
+// Resume resumes a paused recording at time t.
+func (vw *VideoWriter) Resume(t time.Time) {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	if vw.pausedAt.IsZero() {
+		return
+	}
+	vw.gap += t.Sub(vw.pausedAt)
+	vw.pausedAt = time.Time{}
+}
+
+// AddChapter adds a chapter that starts at time t. In CFR mode,
+// where timestamps don't follow the clock, it starts with the next
+// frame instead. Chapters are written when the recording is finished.
+func (vw *VideoWriter) AddChapter(t time.Time, title string) {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	if !vw.pausedAt.IsZero() {
+		t = vw.pausedAt
+	}
+	var tc uint64
+	switch {
+	case vw.firstTime.IsZero():
+	case vw.cfr:
+		// The frame we're holding back will be written at index
+		// idx.
+		tc = uint64((vw.idx + 1) * int(time.Second/time.Duration(vw.fps)))
+	default:
+		if d := t.Add(-vw.gap).Sub(vw.firstTime); d > 0 {
+			tc = uint64(d)
+		}
+	}
+	vw.chMu.Lock()
+	vw.chapters = append(vw.chapters, chapter{tc, title})
+	vw.chMu.Unlock()
+}
+
+// Snapshot returns a copy of the most recent frame.
+func (vw *VideoWriter) Snapshot() (*image.RGBA, error) {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	if vw.prevFrame.Data == nil {
+		return nil, errors.New("no frame has been captured yet")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, vw.canvas.Width, vw.canvas.Height))
+	src := vw.prevFrame.Data
+	for i := 0; i+3 < len(src) && i+3 < len(img.Pix); i += bytesPerPixel {
+		img.Pix[i+0] = src[i+2]
+		img.Pix[i+1] = src[i+1]
+		img.Pix[i+2] = src[i+0]
+		img.Pix[i+3] = 255
+	}
+	return img, nil
+}
+
+// Dump writes the frames currently held in memory to w, as a
+// complete Matroska stream starting at timestamp 0. It may be called
+// concurrently with SendFrame, but only in replay mode.
+func (vw *VideoWriter) Dump(w io.Writer) error {
+	if vw.ring == nil {
+		return errors.New("not in replay mode")
+	}
+	blocks := vw.ring.acquire()
+	defer vw.ring.release()
+
+	out, err := vw.newOutput(w, &matroska.MKV{SegmentUID: newUID()})
+	if err != nil {
+		return err
+	}
+	if len(blocks) > 0 {
+		base := blocks[0].tc
+		for _, b := range blocks {
+			if err := vw.writeFrame(out, b.tc-base, b.dur, b.data, false); err != nil {
+				return err
+			}
+		}
+		vw.addChapters(out, base, base+uint64(out.End()), base)
+	}
+	return out.Close()
+}
+
+// Close finishes the recording. It writes the pending frame and, if
+// the output is seekable, writes the Cues, fills in the SeekHead and
+// the Duration, and sets the final size of the Segment. It does not
+// close the writer passed to NewVideoWriter, but does close the files
+// created by Split.
+func (vw *VideoWriter) Close() error {
+	vw.mu.Lock()
+	defer vw.mu.Unlock()
+	if vw.prevFrame.Data != nil {
+		// We always hold back one frame, because we don't know its
+		// duration until the next one arrives. The last frame gets
+		// the nominal duration of one frame.
+		d := time.Second / time.Duration(vw.fps)
+		vw.pausedAt = time.Time{}
+		frame := Frame{Data: vw.prevFrame.Data, Time: vw.prevFrame.Time.Add(vw.gap + d), Page: vw.prevFrame.Page}
+		frame.Page.Retain()
+		if err := vw.sendFrame(frame); err != nil {
+			return err
+		}
+		vw.prevFrame.Page.Release()
+		vw.prevFrame = Frame{}
+	}
+	if vw.compressor != nil {
+		if err := vw.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if vw.out == nil {
+		return nil
+	}
+	vw.addChapters(vw.out, vw.from, math.MaxUint64, vw.base)
+	// The last part isn't followed by another one.
+	vw.out.NextUID = [16]byte{}
+	if err := vw.out.Close(); err != nil {
+		return err
+	}
+	if vw.partFile != nil {
+		return vw.partFile.Close()
+	}
+	return nil
 }
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"honnef.co/go/xcapture/internal/matroska"
+)
+
+func TestRoundTrip(t *testing.T) {
+	const fps = 25
+	canvas := Canvas{Width: 4, Height: 3}
+	offsets := []time.Duration{0, 40 * time.Millisecond, 100 * time.Millisecond, 1100 * time.Millisecond}
+
+	for _, cfr := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			for _, seekable := range []bool{false, true} {
+				var w io.Writer
+				var buf bytes.Buffer
+				var f *os.File
+				if seekable {
+					var err error
+					f, err = ioutil.TempFile("", "xcapture")
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer os.Remove(f.Name())
+					defer f.Close()
+					w = f
+				} else {
+					w = &buf
+				}
+
+				tags := map[string]string{"WINDOW_ID": "42"}
+				vw := NewVideoWriter(canvas, fps, cfr, tags, w)
+				vw.Compress = compress
+				vw.Workers = 2
+				if err := vw.Start(); err != nil {
+					t.Fatal(err)
+				}
+				start := time.Now()
+				var frames [][]byte
+				for i, off := range offsets {
+					data := make([]byte, canvas.Width*canvas.Height*bytesPerPixel)
+					for j := range data {
+						data[j] = byte(i*31 + j)
+					}
+					frames = append(frames, data)
+					if i == 2 {
+						vw.AddChapter(start.Add(off), "third")
+					}
+					if err := vw.SendFrame(Frame{Data: data, Time: start.Add(off)}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := vw.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				var r io.Reader = &buf
+				if seekable {
+					if _, err := f.Seek(0, io.SeekStart); err != nil {
+						t.Fatal(err)
+					}
+					r = f
+				}
+				mr, err := matroska.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(mr.Segment.Tracks) != 1 {
+					t.Fatalf("got %d tracks, want 1", len(mr.Segment.Tracks))
+				}
+				if v := mr.Segment.Tracks[0].Video; v == nil || v.PixelWidth != canvas.Width || v.PixelHeight != canvas.Height {
+					t.Errorf("got video settings %+v, want %dx%d", v, canvas.Width, canvas.Height)
+				}
+				if got := mr.Segment.Tags["WINDOW_ID"]; got != "42" {
+					t.Errorf("got WINDOW_ID %q, want %q", got, "42")
+				}
+
+				frameDur := time.Second / fps
+				for i := range frames {
+					p, err := mr.ReadPacket()
+					if err != nil {
+						t.Fatalf("cfr=%t compress=%t seekable=%t: frame %d: %v", cfr, compress, seekable, i, err)
+					}
+					wantTC := offsets[i]
+					var wantDur time.Duration
+					if cfr {
+						wantTC = time.Duration(i) * frameDur
+						wantDur = frameDur
+					} else if i < len(offsets)-1 {
+						wantDur = offsets[i+1] - offsets[i]
+					} else {
+						wantDur = frameDur
+					}
+					if p.Timecode != wantTC || p.Duration != wantDur {
+						t.Errorf("cfr=%t compress=%t seekable=%t: frame %d at %s for %s, want %s for %s",
+							cfr, compress, seekable, i, p.Timecode, p.Duration, wantTC, wantDur)
+					}
+					if !p.Keyframe {
+						t.Errorf("frame %d isn't a keyframe", i)
+					}
+					if !bytes.Equal(p.Data, frames[i]) {
+						t.Errorf("cfr=%t compress=%t seekable=%t: frame %d has wrong contents", cfr, compress, seekable, i)
+					}
+				}
+				if _, err := mr.ReadPacket(); err != io.EOF {
+					t.Fatalf("got %v after the last frame, want io.EOF", err)
+				}
+
+				if len(mr.Chapters) != 1 || mr.Chapters[0].Title != "third" {
+					t.Errorf("got chapters %v, want a single one", mr.Chapters)
+				} else {
+					// The chapter starts with the third frame, in
+					// the writer's timeline rather than the clock's.
+					want := offsets[2]
+					if cfr {
+						want = 2 * frameDur
+					}
+					if got := mr.Chapters[0].Start; got != want {
+						t.Errorf("cfr=%t compress=%t seekable=%t: chapter starts at %s, want %s", cfr, compress, seekable, got, want)
+					}
+				}
+				if seekable {
+					if len(mr.Cues) != len(frames) {
+						t.Errorf("got %d cues, want %d", len(mr.Cues), len(frames))
+					}
+					if cfr {
+						if want := time.Duration(len(frames)) * frameDur; mr.Segment.Duration != want {
+							t.Errorf("compress=%t: got duration %s, want %s", compress, mr.Segment.Duration, want)
+						}
+					} else if mr.Segment.Duration == 0 {
+						t.Error("file has no duration")
+					}
+				}
+			}
+		}
+	}
+}
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestResize(t *testing.T) {
+	const fps = 10
+	sizes := []Canvas{{2, 2}, {2, 2}, {3, 1}, {3, 1}, {1, 1}}
+	for _, compress := range []bool{false, true} {
+		var parts []*bytes.Buffer
+		// The window got resized before the first frame, which
+		// mustn't leave an empty part behind.
+		vw := NewVideoWriter(Canvas{4, 4}, fps, false, nil, nil)
+		vw.Compress = compress
+		vw.Split = func(int) (io.WriteCloser, error) {
+			buf := &bytes.Buffer{}
+			parts = append(parts, buf)
+			return nopCloser{buf}, nil
+		}
+		if err := vw.Start(); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		for i, c := range sizes {
+			data := bytes.Repeat([]byte{byte(i)}, c.Width*c.Height*bytesPerPixel)
+			sent := c
+			if i == 3 {
+				// Frames without a size keep the size of the
+				// previous one, even right after a resize.
+				sent = Canvas{}
+			}
+			if err := vw.SendFrame(Frame{Data: data, Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Canvas: sent}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := vw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(parts) != 3 {
+			t.Fatalf("compress=%t: got %d parts, want 3", compress, len(parts))
+		}
+		var prev [16]byte
+		i := 0
+		for n, part := range parts {
+			mr, err := matroska.NewReader(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mr.Segment.PrevUID != prev {
+				t.Errorf("compress=%t: part %d isn't linked to the previous one", compress, n)
+			}
+			prev = mr.Segment.SegmentUID
+			v := mr.Segment.Tracks[0].Video
+			for {
+				p, err := mr.ReadPacket()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c := sizes[i]; v.PixelWidth != c.Width || v.PixelHeight != c.Height || len(p.Data) != c.Width*c.Height*bytesPerPixel {
+					t.Errorf("compress=%t: frame %d of %d bytes in a %dx%d part, want %dx%d", compress, i, len(p.Data), v.PixelWidth, v.PixelHeight, c.Width, c.Height)
+				}
+				if want := time.Duration(i) * 100 * time.Millisecond; p.Timecode != want || p.Data[0] != byte(i) {
+					t.Errorf("compress=%t: got frame %d at %s, want frame %d at %s", compress, p.Data[0], p.Timecode, i, want)
+				}
+				i++
+			}
+		}
+		if i != len(sizes) {
+			t.Errorf("compress=%t: got %d frames, want %d", compress, i, len(sizes))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/ewmh"
+	"github.com/BurntSushi/xgbutil/icccm"
+	"github.com/BurntSushi/xgbutil/xcursor"
+)
+
+// clientWindow returns the client window inside w, which may be a
+// frame created by the window manager. If w has no client window, it
+// is returned unchanged.
+func clientWindow(xu *xgbutil.XUtil, w xproto.Window) xproto.Window {
+	if c, ok := findClient(xu, w); ok {
+		return c
+	}
+	return w
+}
+
+func findClient(xu *xgbutil.XUtil, w xproto.Window) (xproto.Window, bool) {
+	// Window managers set WM_STATE on the client windows they manage.
+	if _, err := icccm.WmStateGet(xu, w); err == nil {
+		return w, true
+	}
+	tree, err := xproto.QueryTree(xu.Conn(), w).Reply()
+	if err != nil {
+		return 0, false
+	}
+	for _, child := range tree.Children {
+		if c, ok := findClient(xu, child); ok {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// topLevel returns the child of the root window that contains w.
+func topLevel(xu *xgbutil.XUtil, w xproto.Window) (xproto.Window, error) {
+	for {
+		tree, err := xproto.QueryTree(xu.Conn(), w).Reply()
+		if err != nil {
+			return 0, err
+		}
+		if tree.Parent == tree.Root || tree.Parent == 0 {
+			return w, nil
+		}
+		w = tree.Parent
+	}
+}
+
+// windowTitle returns the title of w, preferring the UTF-8 title set
+// by EWMH clients.
+func windowTitle(xu *xgbutil.XUtil, w xproto.Window) string {
+	if title, err := ewmh.WmNameGet(xu, w); err == nil && title != "" {
+		return title
+	}
+	title, _ := icccm.WmNameGet(xu, w)
+	return title
+}
+
+// A windowSelector picks a client window by its properties. Only
+// windows that are visible match, and zero fields match any window.
+type windowSelector struct {
+	// Name matches the window's title.
+	Name *regexp.Regexp
+	// Class matches either part of WM_CLASS, ignoring case.
+	Class string
+	// PID matches _NET_WM_PID.
+	PID int
+	// Active restricts the selection to the active window.
+	Active bool
+}
+
+// find returns the topmost window that matches.
+func (sel windowSelector) find(xu *xgbutil.XUtil) (xproto.Window, bool) {
+	var candidates []xproto.Window
+	if sel.Active {
+		w, err := ewmh.ActiveWindowGet(xu)
+		if err != nil || w == 0 {
+			return 0, false
+		}
+		candidates = []xproto.Window{clientWindow(xu, w)}
+	} else {
+		candidates = clientWindows(xu)
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if sel.matches(xu, candidates[i]) {
+			return candidates[i], true
+		}
+	}
+	return 0, false
+}
+
+func (sel windowSelector) matches(xu *xgbutil.XUtil, w xproto.Window) bool {
+	attrs, err := xproto.GetWindowAttributes(xu.Conn(), w).Reply()
+	if err != nil || attrs.MapState != xproto.MapStateViewable {
+		return false
+	}
+	if sel.Name != nil && !sel.Name.MatchString(windowTitle(xu, w)) {
+		return false
+	}
+	if sel.Class != "" {
+		class, err := icccm.WmClassGet(xu, w)
+		if err != nil || (!strings.EqualFold(class.Class, sel.Class) && !strings.EqualFold(class.Instance, sel.Class)) {
+			return false
+		}
+	}
+	if sel.PID != 0 {
+		pid, err := ewmh.WmPidGet(xu, w)
+		if err != nil || int(pid) != sel.PID {
+			return false
+		}
+	}
+	return true
+}
+
+// clientWindows returns all client windows, from the bottom to the
+// top of the stack.
+func clientWindows(xu *xgbutil.XUtil) []xproto.Window {
+	if ws, err := ewmh.ClientListStackingGet(xu); err == nil {
+		return ws
+	}
+	if ws, err := ewmh.ClientListGet(xu); err == nil {
+		return ws
+	}
+	// Without an EWMH window manager, look at the children of the
+	// root window, which QueryTree returns in stacking order.
+	tree, err := xproto.QueryTree(xu.Conn(), xu.RootWin()).Reply()
+	if err != nil {
+		return nil
+	}
+	ws := make([]xproto.Window, len(tree.Children))
+	for i, child := range tree.Children {
+		ws[i] = clientWindow(xu, child)
+	}
+	return ws
+}
+
+var errSelectionCanceled = errors.New("selection canceled")
+
+// selectWindow grabs the pointer and lets the user click on the window
+// to capture. Clicking with any button other than the first cancels
+// the selection.
+func selectWindow(xu *xgbutil.XUtil) (xproto.Window, error) {
+	cursor, err := xcursor.CreateCursor(xu, xcursor.Crosshair)
+	if err != nil {
+		return 0, err
+	}
+	defer xproto.FreeCursor(xu.Conn(), cursor)
+	grab, err := xproto.GrabPointer(xu.Conn(), false, xu.RootWin(),
+		uint16(xproto.EventMaskButtonPress|xproto.EventMaskButtonRelease),
+		xproto.GrabModeAsync, xproto.GrabModeAsync, xproto.WindowNone, cursor, xproto.TimeCurrentTime).Reply()
+	if err != nil {
+		return 0, err
+	}
+	if grab.Status != xproto.GrabStatusSuccess {
+		return 0, errors.New("couldn't grab the pointer, another program seems to have grabbed it")
+	}
+	defer xproto.UngrabPointer(xu.Conn(), xproto.TimeCurrentTime)
+
+	var button xproto.Button
+	var child xproto.Window
+	for {
+		ev, xerr := xu.Conn().WaitForEvent()
+		if ev == nil && xerr == nil {
+			return 0, errors.New("connection to X server closed")
+		}
+		switch ev := ev.(type) {
+		case xproto.ButtonPressEvent:
+			if button == 0 {
+				button, child = ev.Detail, ev.Child
+			}
+		case xproto.ButtonReleaseEvent:
+			// Hold on to the pointer until the button is released, so
+			// that the click doesn't reach the window.
+			if button == 0 || ev.Detail != button {
+				continue
+			}
+			if button != xproto.ButtonIndex1 {
+				return 0, errSelectionCanceled
+			}
+			if child == 0 {
+				return 0, errors.New("clicked on the root window")
+			}
+			return clientWindow(xu, child), nil
+		}
+	}
+}
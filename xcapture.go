@@ -1,14 +1,22 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"image/png"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -17,15 +25,16 @@ import (
 	"github.com/BurntSushi/xgb"
 	"github.com/BurntSushi/xgb/composite"
 	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/randr"
 	xshm "github.com/BurntSushi/xgb/shm"
 	"github.com/BurntSushi/xgb/xfixes"
 	"github.com/BurntSushi/xgb/xproto"
 	"github.com/BurntSushi/xgbutil"
 	"github.com/codahale/hdrhistogram"
+	"golang.org/x/sys/unix"
 )
 
 const bytesPerPixel = 4
-const numPages = 4
 
 func min(xs ...int) int {
 	if len(xs) == 0 {
@@ -40,12 +49,31 @@ func min(xs ...int) int {
 	return m
 }
 
+func max(xs ...int) int {
+	if len(xs) == 0 {
+		return 0
+	}
+	m := xs[0]
+	for _, x := range xs[1:] {
+		if x > m {
+			m = x
+		}
+	}
+	return m
+}
+
 // TODO(dh): this definition of a window is specific to Linux. On
 // Windows, for example, we wouldn't have an integer specifier for the
 // window.
 
 type Window struct {
 	ID int
+	// Region is set if we're capturing a fixed rectangle of the root
+	// window, starting at X, Y, instead of a window. In that case, ID
+	// is the ID of the root window.
+	Region bool
+	X      int
+	Y      int
 
 	mu          sync.RWMutex
 	width       int
@@ -67,6 +95,17 @@ func (w *Window) Dimensions() (width, height, border int) {
 	return w.width, w.height, w.borderWidth
 }
 
+// Contains reports whether the rectangle, in the coordinates of the
+// window, overlaps with the captured area.
+func (w *Window) Contains(r xproto.Rectangle) bool {
+	if !w.Region {
+		return true
+	}
+	width, height, _ := w.Dimensions()
+	return int(r.X) < w.X+width && int(r.X)+int(r.Width) > w.X &&
+		int(r.Y) < w.Y+height && int(r.Y)+int(r.Height) > w.Y
+}
+
 type Canvas struct {
 	Width  int
 	Height int
@@ -75,6 +114,12 @@ type Canvas struct {
 type Frame struct {
 	Data []byte
 	Time time.Time
+	// Page is the page of the frame pool that holds Data, if any.
+	// Whoever holds on to the frame owns a reference to it.
+	Page *Page
+	// Canvas is the size of the frame. If it is set and differs from
+	// the size of the previous frame, the writer starts a new part.
+	Canvas Canvas
 }
 
 type Buffer struct {
@@ -82,10 +127,33 @@ type Buffer struct {
 	PageSize int
 	Data     []byte
 	ShmID    int
+
+	// stride is PageSize rounded up to a multiple of the system's
+	// page size, so that every page starts on a page boundary, as
+	// vmsplice wants it.
+	stride int
+	seg    *shm.Segment
+	addr   unsafe.Pointer
+	loans  *pageLoans
+}
+
+// pageLoans tracks pages that have been handed to the kernel with
+// vmsplice. They must not be modified until the reader of the pipe
+// has consumed them.
+type pageLoans struct {
+	mu sync.Mutex
+	// until holds, for each page, the position in the output up to
+	// which it is in use, or 0.
+	until []int
+}
+
+func alignPage(n int) int {
+	ps := os.Getpagesize()
+	return (n + ps - 1) / ps * ps
 }
 
 func (b Buffer) PageOffset(idx int) int {
-	return b.PageSize * idx
+	return b.stride * idx
 }
 
 func (b Buffer) Page(idx int) []byte {
@@ -94,6 +162,59 @@ func (b Buffer) Page(idx int) []byte {
 	return b.Data[offset : offset+size : offset+size]
 }
 
+// PageIndex returns the index of the page that data belongs to, or
+// -1 if it isn't part of the buffer.
+func (b Buffer) PageIndex(data []byte) int {
+	if len(data) == 0 || len(b.Data) == 0 {
+		return -1
+	}
+	off := uintptr(unsafe.Pointer(&data[0])) - uintptr(unsafe.Pointer(&b.Data[0]))
+	if off >= uintptr(len(b.Data)) {
+		return -1
+	}
+	return int(off) / b.stride
+}
+
+// Lend marks the page that data belongs to as being in use by the
+// output until the output has been consumed up to position until.
+func (b Buffer) Lend(data []byte, until int) {
+	idx := b.PageIndex(data)
+	if idx == -1 {
+		return
+	}
+	b.loans.mu.Lock()
+	b.loans.until[idx] = until
+	b.loans.mu.Unlock()
+}
+
+// Wait blocks until page idx is no longer lent to the output.
+// consumed reports how far the output has been consumed.
+func (b Buffer) Wait(idx int, consumed func() (int, error)) error {
+	for {
+		b.loans.mu.Lock()
+		until := b.loans.until[idx]
+		b.loans.mu.Unlock()
+		if until == 0 {
+			return nil
+		}
+		n, err := consumed()
+		if err != nil {
+			return err
+		}
+		if n >= until {
+			b.loans.mu.Lock()
+			if b.loans.until[idx] == until {
+				b.loans.until[idx] = 0
+			}
+			b.loans.mu.Unlock()
+			continue
+		}
+		// There's no way of being notified when a pipe's reader
+		// makes progress.
+		time.Sleep(time.Millisecond)
+	}
+}
+
 type BitmapInfoHeader struct {
 	Size          uint32
 	Width         int32
@@ -108,13 +229,16 @@ type BitmapInfoHeader struct {
 	ClrImportant  uint32
 }
 
-func NewBuffer(pageSize, pages int) (Buffer, error) {
-	size := pageSize * pages
-	seg, err := shm.Create(size)
-	if err != nil {
-		return Buffer{}, err
-	}
-	data, err := seg.Attach()
+// NewBuffer allocates a buffer in shared memory. The share function
+// has to attach the segment in the X server. Once it returns, the
+// segment is marked for destruction, so that it doesn't leak if we
+// get killed.
+func NewBuffer(pageSize, pages int, share func(shmID int) error) (Buffer, error) {
+	stride := alignPage(pageSize)
+	size := stride * pages
+	seg, data, err := shm.CreateShared(size, func(seg *shm.Segment) error {
+		return share(seg.ID)
+	})
 	if err != nil {
 		return Buffer{}, err
 	}
@@ -129,9 +253,41 @@ func NewBuffer(pageSize, pages int) (Buffer, error) {
 		PageSize: pageSize,
 		Data:     b,
 		ShmID:    seg.ID,
+		stride:   stride,
+		seg:      seg,
+		addr:     data,
+		loans:    &pageLoans{until: make([]int, pages)},
+	}, nil
+}
+
+// NewMemoryBuffer allocates a buffer in ordinary memory, for use
+// when we can't share memory with the X server. The memory is mapped
+// directly, so that its pages are aligned like those of shared
+// memory.
+func NewMemoryBuffer(pageSize, pages int) (Buffer, error) {
+	stride := alignPage(pageSize)
+	data, err := unix.Mmap(-1, 0, stride*pages, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return Buffer{}, err
+	}
+	return Buffer{
+		Pages:    pages,
+		PageSize: pageSize,
+		Data:     data,
+		ShmID:    -1,
+		stride:   stride,
+		loans:    &pageLoans{until: make([]int, pages)},
 	}, nil
 }
 
+// Close detaches the buffer. The buffer must not be used afterwards.
+func (b Buffer) Close() error {
+	if b.seg == nil {
+		return unix.Munmap(b.Data)
+	}
+	return b.seg.Detach(b.addr)
+}
+
 type EventLoop struct {
 	conn *xgb.Conn
 
@@ -168,41 +324,81 @@ func (el *EventLoop) start() {
 
 type CaptureEvent struct {
 	Resized bool
+	// Mapped, Unmapped and Destroyed report changes to the state of
+	// the captured window.
+	Mapped    bool
+	Unmapped  bool
+	Destroyed bool
 }
 
-type ResizeMonitor struct {
+// A WindowMonitor watches the captured window for changes in size
+// and for being mapped, unmapped or destroyed.
+type WindowMonitor struct {
 	C    chan CaptureEvent
 	elCh chan xgb.Event
 	win  *Window
 }
 
-func NewResizeMonitor(el *EventLoop, win *Window) *ResizeMonitor {
-	res := &ResizeMonitor{
+func NewWindowMonitor(el *EventLoop, win *Window) *WindowMonitor {
+	mon := &WindowMonitor{
 		C:    make(chan CaptureEvent, 1),
 		elCh: make(chan xgb.Event),
 		win:  win,
 	}
-	el.Register(res.elCh)
-	go res.start()
-	return res
+	el.Register(mon.elCh)
+	go mon.start()
+	return mon
 }
 
-func (res *ResizeMonitor) start() {
-	for ev := range res.elCh {
-		if ev, ok := ev.(xproto.ConfigureNotifyEvent); ok {
-			w, h, bw := res.win.Dimensions()
+func (mon *WindowMonitor) start() {
+	id := xproto.Window(mon.win.ID)
+	for ev := range mon.elCh {
+		switch ev := ev.(type) {
+		case xproto.ConfigureNotifyEvent:
+			if ev.Event != id {
+				continue
+			}
+			w, h, bw := mon.win.Dimensions()
 			if int(ev.Width) != w || int(ev.Height) != h || int(ev.BorderWidth) != bw {
 				w, h, bw = int(ev.Width), int(ev.Height), int(ev.BorderWidth)
-				res.win.SetDimensions(w, h, bw)
-				select {
-				case res.C <- CaptureEvent{true}:
-				default:
-				}
+				mon.win.SetDimensions(w, h, bw)
+				mon.send(CaptureEvent{Resized: true})
+			}
+		case xproto.MapNotifyEvent:
+			if ev.Event == id {
+				mon.send(CaptureEvent{Mapped: true})
+			}
+		case xproto.UnmapNotifyEvent:
+			if ev.Event == id {
+				mon.send(CaptureEvent{Unmapped: true})
+			}
+		case xproto.DestroyNotifyEvent:
+			if ev.Event == id {
+				mon.send(CaptureEvent{Destroyed: true})
 			}
 		}
 	}
 }
 
+// send sends ev without blocking, so that the event loop doesn't stall
+// once nobody is capturing anymore. If the previous event hasn't been
+// received yet, the two get merged, keeping the latest state of the
+// window.
+func (mon *WindowMonitor) send(ev CaptureEvent) {
+	for {
+		select {
+		case mon.C <- ev:
+			return
+		case old := <-mon.C:
+			if !ev.Mapped && !ev.Unmapped {
+				ev.Mapped, ev.Unmapped = old.Mapped, old.Unmapped
+			}
+			ev.Resized = ev.Resized || old.Resized
+			ev.Destroyed = ev.Destroyed || old.Destroyed
+		}
+	}
+}
+
 type DamageMonitor struct {
 	C    chan CaptureEvent
 	elCh chan xgb.Event
@@ -234,7 +430,10 @@ func (dmg *DamageMonitor) startDamage() {
 	damage.Create(dmg.conn, xdmg, xproto.Drawable(dmg.win.ID), damage.ReportLevelRawRectangles)
 
 	for ev := range dmg.elCh {
-		if _, ok := ev.(damage.NotifyEvent); ok {
+		if ev, ok := ev.(damage.NotifyEvent); ok {
+			if !dmg.win.Contains(ev.Area) {
+				continue
+			}
 			select {
 			case dmg.C <- CaptureEvent{}:
 			default:
@@ -254,7 +453,7 @@ func (dmg *DamageMonitor) startCursor() {
 			log.Println("Couldn't query cursor position:", err)
 			continue
 		}
-		c := struct{ X, Y int }{int(cursor.WinX), int(cursor.WinY)}
+		c := struct{ X, Y int }{int(cursor.WinX) - dmg.win.X, int(cursor.WinY) - dmg.win.Y}
 		if c == prevCursor {
 			continue
 		}
@@ -300,20 +499,219 @@ func parseSize(s string) (width, height int, err error) {
 	return width, height, err
 }
 
+func parseRegion(s string) (x, y, width, height int, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("%q is not a valid region specification", s)
+	}
+	var vs [4]int
+	for i, part := range parts {
+		vs[i], err = strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid region: %s", err)
+		}
+	}
+	if vs[2] <= 0 || vs[3] <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("%q is not a valid region specification", s)
+	}
+	return vs[0], vs[1], vs[2], vs[3], nil
+}
+
+// parseByteSize parses a number of bytes with an optional K, M, G or
+// T suffix, denoting powers of 1024.
+func parseByteSize(s string) (int, error) {
+	num := s
+	mult := 1
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i != -1 {
+			mult = 1 << (10 * uint(i+1))
+			num = s[:n-1]
+		}
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a valid size", s)
+	}
+	return n * mult, nil
+}
+
+// partName returns the name of the nth part of a split recording,
+// inserting the part number before the file extension:
+// out.mkv becomes out-001.mkv.
+func partName(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// exitDestroyed is the exit status when recording stopped because the
+// captured window was destroyed.
+const exitDestroyed = 3
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "info":
+			infoMain(os.Args[2:])
+			return
+		case "repair":
+			repairMain(os.Args[2:])
+			return
+		case "list":
+			listMain(os.Args[2:])
+			return
+		}
+	}
+
 	fps := flag.Uint("fps", 30, "FPS")
 	winID := flag.Int("win", 0, "Window ID")
+	name := flag.String("name", "", "Capture the window whose title matches `regexp`")
+	class := flag.String("class", "", "Capture the window whose WM_CLASS instance or class is `name`")
+	pid := flag.Int("pid", 0, "Capture the window of the process with this PID")
+	active := flag.Bool("active", false, "Capture the active window. Combined with -name, -class or -pid, only if it matches")
+	selectWin := flag.Bool("select", false, "Capture the window that gets clicked on")
+	wait := flag.Bool("wait", false, "Wait for a window matching -name, -class, -pid or -active to appear")
+	region := flag.String("region", "", "Capture a region of the screen instead of a window, in the format X,Y,W,H")
+	monitor := flag.String("monitor", "", "Capture a monitor instead of a window, by its RandR output name")
 	size := flag.String("size", "", "Canvas size in the format WxH in pixels. Defaults to the initial size of the captured window")
 	cfr := flag.Bool("cfr", false, "Use a constant frame rate")
+	replay := flag.Duration("replay", 0, "Instead of writing to standard output, keep the last `duration` of video in memory and save it to a file on SIGUSR1")
+	replayDir := flag.String("replay-dir", ".", "Directory to save replays in")
+	compress := flag.Bool("compress", false, "Compress frames with zlib. The output remains a valid Matroska file")
+	withPopups := flag.Bool("popups", true, "Include menus, tooltips and dialogs of the captured window")
+	withChapters := flag.Bool("chapters", true, "Add chapters when the title of the captured window changes, or when it gains or loses focus")
+	control := flag.String("control", "", "Accept commands on a Unix socket at `path`")
+	output := flag.String("output", "", "Write to `file` instead of standard output")
+	splitSize := flag.String("split-size", "", "Start a new file when the current one reaches `size` bytes. Accepts K, M, G and T suffixes. Requires -output")
+	splitDuration := flag.Duration("split-duration", 0, "Start a new file when the current one reaches `duration`. Requires -output")
+	splitRebase := flag.Bool("split-rebase", false, "Start the timestamps of each file at 0, instead of continuing those of the previous file")
+	splice := flag.Bool("splice", false, "If the output is a pipe, pass frames to it with vmsplice instead of copying them. Can't be combined with -compress, -replay or splitting")
+	framePool := flag.Int("frame-pool", 8, "Number of frames that can be in flight between capturing and writing. At least 3")
+	drop := flag.Bool("drop", false, "Drop captured frames when all frames of the pool are in use, instead of waiting for the writer")
+	unmapped := flag.String("unmapped", "freeze", "What to record while the window is unmapped or minimized: freeze (repeat the last frame), black or pause")
+	fitMode := flag.String("fit", "crop", "How to draw the window when its size differs from the canvas: crop, pad-center, pad-anchor=<nw|n|ne|w|e|sw|s|se>, scale, stretch or adaptive")
+	filter := flag.String("filter", "bilinear", "Filter for -fit scale and stretch: nearest, bilinear or area")
+	method := flag.String("method", "auto", "Capture method: shm, getimage or auto. getimage is slower but works without MIT-SHM, e.g. over SSH")
 	_ = cfr
 	flag.Parse()
 
-	win := &Window{ID: *winID}
+	switch *method {
+	case "auto", "shm", "getimage":
+	default:
+		log.Fatalf("Invalid capture method %q", *method)
+	}
+	fit, err := parseFit(*fitMode, *filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *unmapped {
+	case "freeze", "black", "pause":
+	default:
+		log.Fatalf("Invalid policy for unmapped windows %q", *unmapped)
+	}
+	if *framePool < 3 {
+		// One frame is held back by the writer, and capturing may
+		// need two.
+		log.Fatal("-frame-pool has to be at least 3")
+	}
+
+	split := *splitSize != "" || *splitDuration > 0
+	if split && *output == "" {
+		log.Fatal("-split-size and -split-duration require -output")
+	}
+	if fit.Mode == FitAdaptive {
+		// Every size of the window gets a part of its own.
+		if *output == "" || *size != "" {
+			log.Fatal("-fit adaptive requires -output and can't be combined with -size")
+		}
+		split = true
+	}
+	if (split || *output != "") && *replay > 0 {
+		log.Fatal("-replay can't be combined with -output or splitting")
+	}
+	splitBytes := 0
+	if *splitSize != "" {
+		var err error
+		splitBytes, err = parseByteSize(*splitSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var sel windowSelector
+	if *name != "" {
+		var err error
+		sel.Name, err = regexp.Compile(*name)
+		if err != nil {
+			log.Fatal("Invalid -name:", err)
+		}
+	}
+	sel.Class = *class
+	sel.PID = *pid
+	sel.Active = *active
+	selecting := sel != (windowSelector{})
+
+	modes := 0
+	for _, set := range []bool{*winID != 0, *region != "", *monitor != "", selecting, *selectWin} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		log.Fatal("Exactly one of -win, -region, -monitor and -select, or a combination of -name, -class, -pid and -active must be specified")
+	}
+	if *wait && !selecting {
+		log.Fatal("-wait requires -name, -class, -pid or -active")
+	}
 
 	xu, err := xgbutil.NewConn()
 	if err != nil {
 		log.Fatal("Couldn't connect to X server:", err)
 	}
+
+	win := &Window{ID: *winID}
+	if *selectWin {
+		fmt.Fprintln(os.Stderr, "Click on the window to capture, or with the right mouse button to cancel")
+		w, err := selectWindow(xu)
+		if err != nil {
+			log.Fatal("Couldn't select window:", err)
+		}
+		win.ID = int(w)
+	} else if selecting {
+		w, ok := sel.find(xu)
+		for !ok && *wait {
+			time.Sleep(100 * time.Millisecond)
+			w, ok = sel.find(xu)
+		}
+		if !ok {
+			log.Fatal("No visible window matches")
+		}
+		win.ID = int(w)
+	}
+	if *region != "" {
+		x, y, w, h, err := parseRegion(*region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		win = &Window{ID: int(xu.RootWin()), Region: true, X: x, Y: y}
+		win.SetDimensions(w, h, 0)
+	} else if *monitor != "" {
+		if err := randr.Init(xu.Conn()); err != nil {
+			log.Fatal("RANDR extension is not available:", err)
+		}
+		mon, err := findMonitor(xu.Conn(), xu.RootWin(), *monitor)
+		if err != nil {
+			log.Fatal("Couldn't find monitor:", err)
+		}
+		win = &Window{ID: int(xu.RootWin()), Region: true, X: mon.X, Y: mon.Y}
+		win.SetDimensions(mon.Width, mon.Height, 0)
+	}
+	if win.Region {
+		w, h, _ := win.Dimensions()
+		root := xu.Screen()
+		if win.X < 0 || win.Y < 0 || win.X+w > int(root.WidthInPixels) || win.Y+h > int(root.HeightInPixels) {
+			log.Fatalf("Region %dx%d+%d+%d doesn't fit on the screen", w, h, win.X, win.Y)
+		}
+	}
 	if err := composite.Init(xu.Conn()); err != nil {
 		log.Fatal("COMPOSITE extension is not available:", err)
 	}
@@ -321,40 +719,57 @@ func main() {
 		log.Fatal("XFIXES extension is not available:", err)
 	}
 	xfixes.QueryVersion(xu.Conn(), 1, 0)
-	if err := xshm.Init(xu.Conn()); err != nil {
-		// TODO(dh) implement a slower version that is not using SHM
-		log.Fatal("MIT-SHM extension is not available:", err)
-	}
-	if err := composite.RedirectWindowChecked(xu.Conn(), xproto.Window(win.ID), composite.RedirectAutomatic).Check(); err != nil {
-		if err, ok := err.(xproto.AccessError); ok {
-			log.Fatal("Can't capture window, another program seems to be capturing it already:", err)
+	useShm := *method != "getimage"
+	if useShm {
+		if err := xshm.Init(xu.Conn()); err != nil {
+			if *method == "shm" {
+				log.Fatal("MIT-SHM extension is not available:", err)
+			}
+			log.Println("MIT-SHM extension is not available, falling back to GetImage:", err)
+			useShm = false
 		}
-		log.Fatal("Can't capture window:", err)
-	}
-	pix, err := xproto.NewPixmapId(xu.Conn())
-	if err != nil {
-		log.Fatal("Could not obtain ID for pixmap:", err)
 	}
-	composite.NameWindowPixmap(xu.Conn(), xproto.Window(win.ID), pix)
 
-	segID, err := xshm.NewSegId(xu.Conn())
-	if err != nil {
-		log.Fatal("Could not obtain ID for SHM:", err)
-	}
+	// src is the drawable we capture from. For windows, that's the
+	// window's composite pixmap, which changes when the window gets
+	// resized. For regions, it's the root window itself.
+	src := xproto.Drawable(win.ID)
+	var pix xproto.Pixmap
+	if !win.Region {
+		if err := composite.RedirectWindowChecked(xu.Conn(), xproto.Window(win.ID), composite.RedirectAutomatic).Check(); err != nil {
+			if err, ok := err.(xproto.AccessError); ok {
+				log.Fatal("Can't capture window, another program seems to be capturing it already:", err)
+			}
+			log.Fatal("Can't capture window:", err)
+		}
+		pix, err = xproto.NewPixmapId(xu.Conn())
+		if err != nil {
+			log.Fatal("Could not obtain ID for pixmap:", err)
+		}
+		composite.NameWindowPixmap(xu.Conn(), xproto.Window(win.ID), pix)
+		src = xproto.Drawable(pix)
 
-	// Register event before we query the window size for the first
-	// time. Otherwise we could race and miss a window resize.
-	err = xproto.ChangeWindowAttributesChecked(xu.Conn(), xproto.Window(win.ID),
-		xproto.CwEventMask, []uint32{uint32(xproto.EventMaskStructureNotify)}).Check()
-	if err != nil {
-		log.Fatal("Couldn't monitor window for size changes:", err)
-	}
-	geom, err := xproto.GetGeometry(xu.Conn(), xproto.Drawable(win.ID)).Reply()
-	if err != nil {
-		log.Fatal("Could not determine window dimensions:", err)
+		// Register event before we query the window size for the first
+		// time. Otherwise we could race and miss a window resize.
+		err = xproto.ChangeWindowAttributesChecked(xu.Conn(), xproto.Window(win.ID),
+			xproto.CwEventMask, []uint32{uint32(xproto.EventMaskStructureNotify)}).Check()
+		if err != nil {
+			log.Fatal("Couldn't monitor window for size changes:", err)
+		}
+		geom, err := xproto.GetGeometry(xu.Conn(), xproto.Drawable(win.ID)).Reply()
+		if err != nil {
+			log.Fatal("Could not determine window dimensions:", err)
+		}
+		win.SetDimensions(int(geom.Width), int(geom.Height), int(geom.BorderWidth))
+		attrs, err := xproto.GetWindowAttributes(xu.Conn(), xproto.Window(win.ID)).Reply()
+		if err != nil {
+			log.Fatal("Could not query window state:", err)
+		}
+		if attrs.MapState != xproto.MapStateViewable {
+			log.Fatal("Can't capture window, it isn't visible")
+		}
 	}
 
-	win.SetDimensions(int(geom.Width), int(geom.Height), int(geom.BorderWidth))
 	var canvas Canvas
 	if *size != "" {
 		width, height, err := parseSize(*size)
@@ -363,50 +778,148 @@ func main() {
 		}
 		canvas = Canvas{width, height}
 	} else {
+		w, h, _ := win.Dimensions()
 		canvas = Canvas{
-			Width:  int(geom.Width),
-			Height: int(geom.Height),
+			Width:  w,
+			Height: h,
 		}
 	}
 
-	buf, err := NewBuffer(canvas.Width*canvas.Height*bytesPerPixel, numPages)
-	if err != nil {
-		log.Fatal("Could not create shared memory:", err)
+	// When the window's size differs from the canvas, we capture at
+	// most the size of the screen, or of the canvas if that's larger.
+	root := xu.Screen()
+	srcCanvas := Canvas{
+		Width:  max(int(root.WidthInPixels), canvas.Width),
+		Height: max(int(root.HeightInPixels), canvas.Height),
+	}
+	pageSize := canvas.Width * canvas.Height * bytesPerPixel
+	if fit.Mode == FitAdaptive {
+		// Frames have the size of the window, so pages have to be
+		// large enough for the largest frame we capture.
+		pageSize = srcCanvas.Width * srcCanvas.Height * bytesPerPixel
+	}
+	var grabber Grabber
+	if useShm {
+		grabber, err = NewShmGrabber(xu.Conn(), pageSize, *framePool)
+		if err != nil {
+			if *method == "shm" {
+				log.Fatal("Could not create shared memory:", err)
+			}
+			// Shared memory can't work if the X server is on a
+			// different machine, even if it supports MIT-SHM.
+			log.Println("Could not create shared memory, falling back to GetImage:", err)
+			grabber = nil
+		}
+	}
+	if grabber == nil {
+		grabber, err = NewImageGrabber(xu.Conn(), pageSize, *framePool)
+		if err != nil {
+			log.Fatal("Could not allocate memory:", err)
+		}
 	}
-	if err := xshm.AttachChecked(xu.Conn(), segID, uint32(buf.ShmID), false).Check(); err != nil {
-		log.Fatal("Could not attach shared memory to X server:", err)
+	buf := grabber.Buffer()
+
+	// When padding or scaling, sizes that differ from the canvas need
+	// the whole window, which we capture into a separate buffer.
+	var source Grabber
+	if fit.Mode != FitCrop && fit.Mode != FitAdaptive {
+		srcSize := srcCanvas.Width * srcCanvas.Height * bytesPerPixel
+		if _, ok := grabber.(*ShmGrabber); ok {
+			source, err = NewShmGrabber(xu.Conn(), srcSize, 1)
+		} else {
+			source, err = NewImageGrabber(xu.Conn(), srcSize, 1)
+		}
+		if err != nil {
+			log.Fatal("Could not allocate memory for scaling:", err)
+		}
 	}
 
-	i := 0
+	pool := NewFramePool(buf)
+	pool.Drop = *drop
 	ch := make(chan Frame)
 
 	tags := map[string]string{
 		"DATE_RECORDED": time.Now().UTC().Format("2006-01-02 15:04:05.999"),
-		"WINDOW_ID":     strconv.Itoa(win.ID),
 	}
-	vw := NewVideoWriter(canvas, int(*fps), *cfr, tags, os.Stdout)
+	if win.Region {
+		w, h, _ := win.Dimensions()
+		tags["REGION"] = fmt.Sprintf("%d,%d,%d,%d", win.X, win.Y, w, h)
+	} else {
+		tags["WINDOW_ID"] = strconv.Itoa(win.ID)
+	}
+	var out io.Writer = os.Stdout
+	if *output != "" && !split {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Couldn't create output file:", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	vw := NewVideoWriter(canvas, int(*fps), *cfr, tags, out)
+	vw.Compress = *compress
+	vw.Workers = runtime.NumCPU()
+	vw.Replay = *replay
+	if *splice {
+		if *compress || *replay > 0 || split {
+			log.Fatal("-splice can't be combined with -compress, -replay or splitting")
+		}
+		if fi, err := os.Stdout.Stat(); err != nil || out != os.Stdout || fi.Mode()&os.ModeNamedPipe == 0 {
+			log.Println("Output isn't a pipe, not using vmsplice")
+		} else {
+			vw.Splice = true
+			vw.Lend = buf.Lend
+		}
+	}
+	if split {
+		vw.Split = func(part int) (io.WriteCloser, error) {
+			return os.Create(partName(*output, part))
+		}
+		vw.SplitSize = splitBytes
+		vw.SplitDuration = *splitDuration
+		vw.SplitRebase = *splitRebase
+	}
 	if err := vw.Start(); err != nil {
 		log.Fatal("Couldn't write output:", err)
 	}
+	if *replay > 0 {
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go func() {
+			for range usr1 {
+				name, err := dumpReplay(vw, *replayDir)
+				if err != nil {
+					log.Println("Couldn't save replay:", err)
+					continue
+				}
+				log.Println("Saved replay to", name)
+			}
+		}()
+	}
 
-	chistMu := &sync.Mutex{}
+	// histMu protects the histograms and counters, which are read by
+	// the stats command of the control socket.
+	histMu := &sync.Mutex{}
 	chist := hdrhistogram.New(int64(1*time.Millisecond), int64(10*time.Second), 3)
 	whist := hdrhistogram.New(int64(1*time.Millisecond), int64(10*time.Second), 3)
 	rhist := hdrhistogram.New(int64(1*time.Millisecond), int64(10*time.Second), 3)
 
 	var lastSlow time.Time
 	var slows uint64
+	start := time.Now()
+	dupped := 0
+	writerDone := make(chan struct{})
 	go func() {
+		defer close(writerDone)
 		d := time.Second / time.Duration(*fps)
-		t := time.NewTicker(d)
-		start := time.Now()
-		dupped := 0
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
 
 		var prevFrameTime time.Time
 		first := true
-		for ts := range t.C {
+		for ts := range ticker.C {
 			if rhist.TotalCount()%int64(*fps) == 0 {
-				chistMu.Lock()
+				histMu.Lock()
 				var cbracket hdrhistogram.Bracket
 				var wbracket hdrhistogram.Bracket
 				var rbracket hdrhistogram.Bracket
@@ -432,7 +945,7 @@ func main() {
 					rbracket = bracket
 				}
 
-				s := "%d frames, %d dup, started recording %s ago\n" +
+				s := "%d frames, %d dup, %d dropped, started recording %s ago\n" +
 					"capture latency min/max/avg: %.2fms/%.2fms/%.2fms±%.2fms (%g %%ile: %.2fms)\n" +
 					"write latency min/max/avg: %.2fms/%.2fms/%.2fms±%.2fms (%g %%ile: %.2fms)\n" +
 					"render loop min/max/avg: %.2fms/%.2fms/%.2fms±%.2fms (%g %%ile: %.2fms)\n" +
@@ -456,41 +969,51 @@ func main() {
 				}
 
 				fmt.Fprintf(os.Stderr, s,
-					whist.TotalCount(), dupped, time.Since(start),
+					whist.TotalCount(), dupped, pool.Drops(), time.Since(start),
 					milliseconds(chist.Min()), milliseconds(chist.Max()), milliseconds(int64(chist.Mean())), milliseconds(int64(chist.StdDev())), cbracket.Quantile, milliseconds(cbracket.ValueAt),
 					milliseconds(whist.Min()), milliseconds(whist.Max()), milliseconds(int64(whist.Mean())), milliseconds(int64(whist.StdDev())), wbracket.Quantile, milliseconds(wbracket.ValueAt),
 					milliseconds(rhist.Min()), milliseconds(rhist.Max()), milliseconds(int64(rhist.Mean())), milliseconds(int64(rhist.StdDev())), rbracket.Quantile, milliseconds(rbracket.ValueAt),
 					dslow, slows)
-				chistMu.Unlock()
+				histMu.Unlock()
 			}
 
 			var err error
 			t := time.Now()
 			select {
-			case frame := <-ch:
+			case frame, ok := <-ch:
+				if !ok {
+					// Capturing has stopped
+					return
+				}
 				err = vw.SendFrame(frame)
 				prevFrameTime = frame.Time
 			default:
+				histMu.Lock()
 				dupped++
+				histMu.Unlock()
 				err = vw.SendFrame(Frame{Time: prevFrameTime.Add(d)})
 				prevFrameTime = prevFrameTime.Add(d)
 			}
+			histMu.Lock()
 			whist.RecordCorrectedValue(int64(time.Since(t)), int64(d))
+			histMu.Unlock()
 			if err != nil {
 				log.Fatal("Couldn't write frame:", err)
 			}
 
 			dt := time.Since(ts)
+			histMu.Lock()
 			if dt > d {
 				lastSlow = time.Now()
 				slows++
 			}
 			rhist.RecordCorrectedValue(int64(dt), int64(d))
+			histMu.Unlock()
 		}
 	}()
 
 	el := NewEventLoop(xu.Conn())
-	res := NewResizeMonitor(el, win)
+	mon := NewWindowMonitor(el, win)
 	var other chan CaptureEvent
 	captureEvents := make(chan CaptureEvent, 1)
 	if *cfr {
@@ -509,21 +1032,214 @@ func main() {
 		dmg := NewDamageMonitor(xu.Conn(), el, win, int(*fps))
 		other = dmg.C
 	}
+	if *withChapters && !win.Region {
+		if _, err := NewChapterMonitor(xu, el, win, vw.AddChapter); err != nil {
+			log.Fatal("Couldn't monitor window title and focus:", err)
+		}
+	}
+	var popups *PopupTracker
+	var popupEvents chan CaptureEvent
+	if *withPopups && !win.Region {
+		// Regions capture the root window, which already includes
+		// all popups.
+		useDamage := !*cfr
+		if *cfr && damage.Init(xu.Conn()) == nil {
+			// Without DAMAGE, we fetch the contents of every popup
+			// for every frame.
+			damage.QueryVersion(xu.Conn(), 1, 1)
+			useDamage = true
+		}
+		popups, err = NewPopupTracker(xu, el, win, useDamage)
+		if err != nil {
+			log.Fatal("Couldn't track popup windows:", err)
+		}
+		popupEvents = popups.C
+	}
 	go func() {
+		mapped := true
 		for {
+			// While the window is unmapped, only changes in its state
+			// matter. Not forwarding anything else keeps -cfr from
+			// spinning until the window gets mapped again.
+			frames, popupFrames := other, popupEvents
+			if !mapped {
+				frames, popupFrames = nil, nil
+			}
 			var ev CaptureEvent
 			select {
-			case ev = <-res.C:
-				captureEvents <- ev
-			case ev = <-other:
-				captureEvents <- ev
+			case ev = <-mon.C:
+				if ev.Mapped {
+					mapped = true
+				} else if ev.Unmapped {
+					mapped = false
+				}
+			case ev = <-frames:
+			case ev = <-popupFrames:
 			}
+			captureEvents <- ev
 		}
 	}()
-	for ev := range captureEvents {
+
+	// Stop capturing on SIGINT or SIGTERM, so that we can write the
+	// remaining frames and finalize the output. A second signal will
+	// kill us the usual way.
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopCapture := func() { stopOnce.Do(func() { close(stop) }) }
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		stopCapture()
+	}()
+
+	var cs *ControlServer
+	if *control != "" {
+		commands := map[string]ControlFunc{
+			"pause": func(string) (interface{}, error) {
+				vw.Pause(time.Now())
+				return nil, nil
+			},
+			"resume": func(string) (interface{}, error) {
+				vw.Resume(time.Now())
+				return nil, nil
+			},
+			"stop": func(string) (interface{}, error) {
+				stopCapture()
+				return nil, nil
+			},
+			"marker": func(label string) (interface{}, error) {
+				if label == "" {
+					return nil, errors.New("missing label")
+				}
+				vw.AddChapter(time.Now(), label)
+				return nil, nil
+			},
+			"snapshot": func(name string) (interface{}, error) {
+				if name == "" {
+					return nil, errors.New("missing file name")
+				}
+				img, err := vw.Snapshot()
+				if err != nil {
+					return nil, err
+				}
+				f, err := os.Create(name)
+				if err != nil {
+					return nil, err
+				}
+				if err := png.Encode(f, img); err != nil {
+					f.Close()
+					return nil, err
+				}
+				return nil, f.Close()
+			},
+			"stats": func(string) (interface{}, error) {
+				histMu.Lock()
+				defer histMu.Unlock()
+				st := Stats{
+					Frames:    whist.TotalCount(),
+					Dupped:    dupped,
+					Dropped:   pool.Drops(),
+					Recording: time.Since(start).Seconds(),
+					Slowdowns: slows,
+					Capture:   latencyStats(chist),
+					Write:     latencyStats(whist),
+					Render:    latencyStats(rhist),
+				}
+				if !lastSlow.IsZero() {
+					t := lastSlow
+					st.LastSlowdown = &t
+				}
+				return st, nil
+			},
+		}
+		if *replay > 0 {
+			commands["save"] = func(string) (interface{}, error) {
+				name, err := dumpReplay(vw, *replayDir)
+				if err != nil {
+					return nil, err
+				}
+				return name, nil
+			}
+		}
+		cs, err = NewControlServer(*control, commands)
+		if err != nil {
+			log.Fatal("Couldn't create control socket:", err)
+		}
+	}
+
+	// getPage returns a page to capture into, or nil if we have to
+	// drop the frame.
+	getPage := func() *Page {
+		page := pool.Get()
+		if page != nil && vw.Splice {
+			if err := buf.Wait(page.Index, vw.Consumed); err != nil {
+				log.Fatal("Couldn't check the output pipe:", err)
+			}
+		}
+		return page
+	}
+
+	// While the window is unmapped, there is nothing to capture.
+	// Depending on the -unmapped policy, the writer keeps repeating
+	// the last frame, or a black one, or the recording gets paused.
+	mapped := true
+	destroyed := false
+	decorate := func(data []byte, c Canvas) {
+		if popups != nil {
+			popups.Draw(data, c)
+		}
+		drawCursor(xu, win, buf, data, c)
+	}
+
+loop:
+	for {
+		var ev CaptureEvent
+		select {
+		case ev = <-captureEvents:
+		case <-stop:
+			break loop
+		}
 		t := time.Now()
-		if ev.Resized {
-			// DRY
+		switch {
+		case ev.Destroyed:
+			log.Println("Window was destroyed, stopping")
+			destroyed = true
+			break loop
+		case ev.Unmapped:
+			mapped = false
+			switch *unmapped {
+			case "black":
+				page := getPage()
+				if page == nil {
+					continue
+				}
+				data, dims := page.Data, canvas
+				if fit.Mode == FitAdaptive {
+					// Pages are larger than the window, and the black
+					// frame has to have the size of the current part.
+					w, h, _ := win.Dimensions()
+					dims = Canvas{min(w, srcCanvas.Width), min(h, srcCanvas.Height)}
+					data = page.Data[:dims.Width*dims.Height*bytesPerPixel]
+				}
+				zero(data)
+				ch <- Frame{Data: data, Time: t, Page: page, Canvas: dims}
+			case "pause":
+				vw.Pause(t)
+			}
+			continue
+		case ev.Mapped:
+			mapped = true
+			if *unmapped == "pause" {
+				vw.Resume(t)
+			}
+		}
+		if !mapped {
+			continue
+		}
+		if (ev.Resized || ev.Mapped) && !win.Region {
+			// The window got a new pixmap.
 			xproto.FreePixmap(xu.Conn(), pix)
 			var err error
 			pix, err = xproto.NewPixmapId(xu.Conn())
@@ -531,40 +1247,98 @@ func main() {
 				log.Fatal("Could not obtain ID for pixmap:", err)
 			}
 			composite.NameWindowPixmap(xu.Conn(), xproto.Window(win.ID), pix)
+			src = xproto.Drawable(pix)
 		}
 
 		w, h, bw := win.Dimensions()
-		offset := buf.PageOffset(i)
-		w = min(w, canvas.Width)
-		h = min(h, canvas.Height)
-
-		ts := time.Now()
-		_, err := xshm.GetImage(xu.Conn(), xproto.Drawable(pix), int16(bw), int16(bw), uint16(w), uint16(h), 0xFFFFFFFF, xproto.ImageFormatZPixmap, segID, uint32(offset)).Reply()
-		if err != nil {
+		page := getPage()
+		if page == nil {
 			continue
 		}
-
-		page := buf.Page(i)
-
-		if w < canvas.Width || h < canvas.Height {
-			i = (i + 1) % numPages
-			dest := buf.Page(i)
-			for i := range dest {
-				dest[i] = 0
+		ts := time.Now()
+		data, dims := page.Data, canvas
+		if fit.Mode == FitAdaptive {
+			// Capture the window at its current size, which starts a
+			// new part when it changes.
+			w = min(w, srcCanvas.Width)
+			h = min(h, srcCanvas.Height)
+			if err := grabber.Grab(src, win.X+bw, win.Y+bw, w, h, page.Index); err != nil {
+				page.Release()
+				continue
+			}
+			data, dims = page.Data[:w*h*bytesPerPixel], Canvas{w, h}
+			decorate(data, dims)
+		} else if source == nil || (w == canvas.Width && h == canvas.Height) {
+			w = min(w, canvas.Width)
+			h = min(h, canvas.Height)
+			if err := grabber.Grab(src, win.X+bw, win.Y+bw, w, h, page.Index); err != nil {
+				page.Release()
+				continue
 			}
-			for i := 0; i < h; i++ {
-				copy(dest[i*canvas.Width*bytesPerPixel:], page[i*w*bytesPerPixel:(i+1)*w*bytesPerPixel])
+			if w < canvas.Width || h < canvas.Height {
+				dest := getPage()
+				if dest == nil {
+					page.Release()
+					continue
+				}
+				fit.Draw(dest.Data, canvas, page.Data, w, h)
+				page.Release()
+				page = dest
+			}
+			data = page.Data
+			decorate(data, canvas)
+		} else {
+			// Capture the whole window, then fit it onto the canvas.
+			// Popups and the cursor are drawn first, so that they get
+			// scaled along with the window.
+			w = min(w, srcCanvas.Width)
+			h = min(h, srcCanvas.Height)
+			if err := source.Grab(src, win.X+bw, win.Y+bw, w, h, 0); err != nil {
+				page.Release()
+				continue
 			}
-			page = dest
+			data := source.Buffer().Page(0)[:w*h*bytesPerPixel]
+			decorate(data, Canvas{w, h})
+			fit.Draw(page.Data, canvas, data, w, h)
 		}
-
-		drawCursor(xu, win, buf, page, canvas)
-		chistMu.Lock()
+		histMu.Lock()
 		chist.RecordValue(int64(time.Since(t)))
-		chistMu.Unlock()
+		histMu.Unlock()
 
-		ch <- Frame{Data: page, Time: ts}
-		i = (i + 1) % numPages
+		// The writer takes over our reference to the page.
+		ch <- Frame{Data: data, Time: ts, Page: page, Canvas: dims}
+	}
+
+	if cs != nil {
+		cs.Close()
+	}
+	close(ch)
+	<-writerDone
+	if err := vw.Close(); err != nil {
+		log.Println("Couldn't finalize output:", err)
+	}
+
+	if popups != nil {
+		popups.Close()
+	}
+	if err := grabber.Close(); err != nil {
+		log.Println("Couldn't release capture buffer:", err)
+	}
+	if source != nil {
+		if err := source.Close(); err != nil {
+			log.Println("Couldn't release capture buffer:", err)
+		}
+	}
+	if !win.Region {
+		xproto.FreePixmap(xu.Conn(), pix)
+		if !destroyed {
+			composite.UnredirectWindow(xu.Conn(), xproto.Window(win.ID), composite.RedirectAutomatic)
+		}
+	}
+	xu.Conn().Sync()
+	xu.Conn().Close()
+	if destroyed {
+		os.Exit(exitDestroyed)
 	}
 }
 
@@ -580,16 +1354,17 @@ func drawCursor(xu *xgbutil.XUtil, win *Window, buf Buffer, page []byte, canvas
 	if err != nil {
 		return
 	}
+	x, y := int(pos.DstX)-win.X, int(pos.DstY)-win.Y
 	w, h, _ := win.Dimensions()
 	w = min(w, canvas.Width)
 	h = min(h, canvas.Height)
-	if pos.DstY < 0 || pos.DstX < 0 || int(pos.DstY) > h || int(pos.DstX) > w {
+	if y < 0 || x < 0 || y > h || x > w {
 		// cursor outside of our window
 		return
 	}
 	for i, p := range cursor.CursorImage {
-		row := i/int(cursor.Width) + int(pos.DstY) - int(cursor.Yhot)
-		col := i%int(cursor.Width) + int(pos.DstX) - int(cursor.Xhot)
+		row := i/int(cursor.Width) + y - int(cursor.Yhot)
+		col := i%int(cursor.Width) + x - int(cursor.Xhot)
 		if row >= canvas.Height || col >= canvas.Width || row < 0 || col < 0 {
 			// cursor is partially off-screen
 			break